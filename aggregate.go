@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// aggregators reduce the values of a value column over the rows of a group
+var aggregators = map[string]func(values []float64) float64{
+	"sum": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+	"avg": func(values []float64) float64 {
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+}
+
+// aggregateRows reduces the rows to a single row per distinct combination of
+// label values, every value column is reduced with the aggregate function
+func (q *Query) aggregateRows(rows []map[string]interface{}, columnTypes map[string]string) ([]map[string]interface{}, error) {
+	aggregate := aggregators[strings.ToLower(q.Aggregate)]
+	if aggregate == nil {
+		return nil, fmt.Errorf("unknown aggregate %q", q.Aggregate)
+	}
+	type group struct {
+		row    map[string]interface{}
+		values map[string][]float64
+	}
+	var groups []*group
+	byKey := make(map[string]*group)
+	for _, res := range rows {
+		labels := make([]string, 0, len(q.Labels))
+		for _, label := range q.Labels {
+			labels = append(labels, fmt.Sprintf("%s", res[label.Column]))
+		}
+		key := strings.Join(labels, "\x00")
+		g, found := byKey[key]
+		if !found {
+			g = &group{
+				row:    make(map[string]interface{}, len(q.Labels)+len(q.Values)),
+				values: make(map[string][]float64, len(q.Values)),
+			}
+			for _, label := range q.Labels {
+				g.row[label.Column] = res[label.Column]
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		for _, valueName := range q.Values {
+			raw, ok := res[valueName]
+			if !ok {
+				continue
+			}
+			value, err := parseFloat(valueName, raw)
+			if err != nil {
+				return nil, withColumnType(err, valueName, columnTypes)
+			}
+			g.values[valueName] = append(g.values[valueName], value)
+		}
+	}
+
+	aggregated := make([]map[string]interface{}, 0, len(groups))
+	for _, g := range groups {
+		for valueName, values := range g.values {
+			g.row[valueName] = aggregate(values)
+		}
+		aggregated = append(aggregated, g.row)
+	}
+	return aggregated, nil
+}
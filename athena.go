@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AthenaConfig sets the go-athena connection parameters, which otherwise
+// have to be given in the query of the athena:// URL
+type AthenaConfig struct {
+	Region         string        `yaml:"region"`          // AWS region, defaults to the one of the environment
+	OutputLocation string        `yaml:"output_location"` // S3 location of the query results, required
+	PollFrequency  time.Duration `yaml:"poll_frequency"`  // how often to poll for results, go-athena defaults to 5s
+}
+
+// UnmarshalYAML reads the poll frequency with parseDuration
+func (a *AthenaConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AthenaConfig
+	return unmarshalWithDurations(unmarshal, (*plain)(a), map[string]*time.Duration{
+		"poll_frequency": &a.PollFrequency,
+	})
+}
+
+// athenaURL adds the settings to the parameters of the athena:// URL and
+// checks that the parameters required by go-athena are present. The database
+// defaults to the path of the URL.
+func (a AthenaConfig) athenaURL(u *url.URL) error {
+	params := u.Query()
+	if a.Region != "" {
+		params.Set("region", a.Region)
+	}
+	if a.OutputLocation != "" {
+		params.Set("output_location", a.OutputLocation)
+	}
+	if a.PollFrequency > 0 {
+		params.Set("poll_frequency", a.PollFrequency.String())
+	}
+	if params.Get("db") == "" {
+		params.Set("db", strings.TrimPrefix(u.Path, "/"))
+	}
+	if params.Get("db") == "" {
+		return fmt.Errorf("athena: the database must be given as path or db parameter")
+	}
+	if params.Get("output_location") == "" {
+		return fmt.Errorf("athena: output_location is required")
+	}
+	if freq := params.Get("poll_frequency"); freq != "" {
+		if _, err := time.ParseDuration(freq); err != nil {
+			return fmt.Errorf("athena: invalid poll_frequency %q", freq)
+		}
+	}
+	u.RawQuery = params.Encode()
+	return nil
+}
+
+// athenaDSN returns the DSN go-athena expects, only the URL parameters
+func athenaDSN(conn string) string {
+	u, err := url.Parse(conn)
+	if err != nil {
+		return conn
+	}
+	return u.RawQuery
+}
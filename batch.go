@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// batchDrivers run several statements sent at once and return a result set
+// per statement
+var batchDrivers = map[string]bool{
+	"postgres":  true,
+	"sqlserver": true,
+}
+
+// batchable reports whether the query can be run as part of a batch. Its
+// result must only depend on its text and it must be a single statement, so
+// that the result sets can be mapped back to the queries.
+func (q *Query) batchable() bool {
+	return q.Type != TypeExec &&
+		len(q.FallbackQueries) == 0 &&
+		len(q.PreSQL) == 0 &&
+		len(q.PostSQL) == 0 &&
+		q.StatementTimeout <= 0 &&
+		q.CacheTTL <= 0 &&
+		q.AutoLimit <= 0 &&
+		q.QueryRetries <= 0 &&
+		!q.Prepare &&
+		len(statementKeywords(q.Query)) == 1
+}
+
+// failedInBatch reports whether the query failed in a batch on the connection
+// and has not succeeded on its own since
+func (q *Query) failedInBatch(conn *connection) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.batchFailures[conn]
+}
+
+// setFailedInBatch records whether the query is left out of the batches of
+// the connection
+func (q *Query) setFailedInBatch(conn *connection, failed bool) {
+	q.Lock()
+	defer q.Unlock()
+	if !failed {
+		delete(q.batchFailures, conn)
+		return
+	}
+	if q.batchFailures == nil {
+		q.batchFailures = make(map[*connection]bool)
+	}
+	q.batchFailures[conn] = true
+}
+
+// runBatch runs the queries in a single round-trip and returns the number of
+// successful queries. A query failing in the batch counts as failed and is
+// run on its own from the next run on, until it succeeds on its own. The
+// queries after it, which the database aborted, are batched again.
+func (j *Job) runBatch(conn *connection, queries []*Query) int {
+	updated := 0
+	batch := make([]*Query, 0, len(queries))
+	for _, q := range queries {
+		if q.failedInBatch(conn) {
+			updated += runAlone(conn, q)
+			continue
+		}
+		batch = append(batch, q)
+	}
+	for len(batch) > 0 {
+		if len(batch) == 1 {
+			updated += runAlone(conn, batch[0])
+			break
+		}
+		results, err := fetchBatch(conn, batch)
+		for i, result := range results {
+			q := batch[i]
+			queryCounter.WithLabelValues(q.jobName, q.Name).Inc()
+			queryRowsProcessedCounter.WithLabelValues(q.jobName, q.Name).Add(float64(len(result.rows)))
+			queryVariantGauge.WithLabelValues(q.jobName, q.Name, conn.host, conn.database).Set(0)
+			if err := q.process(conn, q.Query, result); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+				continue
+			}
+			updated++
+		}
+		if err == nil {
+			level.Debug(j.log).Log("msg", "Ran batch", "queries", len(batch), "host", conn.host)
+			break
+		}
+		// running it again now would count its failure twice
+		failed := batch[len(results)]
+		level.Warn(failed.log).Log("msg", "Query failed in a batch, running it on its own until it succeeds", "err", err, "host", conn.host)
+		queryCounter.WithLabelValues(failed.jobName, failed.Name).Inc()
+		setFailedScrape(conn, failed.jobName, failed.Name, 1.0)
+		failedQueryCounter.WithLabelValues(failed.jobName, failed.Name).Inc()
+		failed.setFailedInBatch(conn, true)
+		batch = batch[len(results)+1:]
+	}
+	return updated
+}
+
+// runAlone runs a batchable query on its own and returns 1 if it succeeded
+func runAlone(conn *connection, q *Query) int {
+	if err := q.Run(conn); err != nil {
+		level.Warn(q.log).Log("msg", "Failed to run query", "err", err)
+		return 0
+	}
+	q.setFailedInBatch(conn, false)
+	return 1
+}
+
+// fetchBatch sends the queries at once and reads a result set per query. If
+// a query fails, the results of the queries before it are returned with the
+// error.
+func fetchBatch(conn *connection, queries []*Query) ([]*queryResult, error) {
+	statements := make([]string, 0, len(queries))
+	for _, q := range queries {
+		// a trailing semicolon would add an empty statement without result
+		// set, the newline ends a trailing line comment
+		statements = append(statements, strings.TrimRight(q.Query, "; \t\r\n"))
+	}
+	sent := time.Now()
+	rows, err := conn.conn.Load().QueryxContext(context.Background(), strings.Join(statements, "\n;\n"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := make([]*queryResult, 0, len(queries))
+	start := sent
+	for i, q := range queries {
+		if i > 0 && !rows.NextResultSet() {
+			if err := rows.Err(); err != nil {
+				return results, err
+			}
+			return results, fmt.Errorf("expected %d result sets, got %d", len(queries), i)
+		}
+		result, err := q.readResult(rows, conn, sent)
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			return results, err
+		}
+		// the statements run one after another, so each took the time since
+		// the result of the previous one
+		end := time.Now()
+		if q.TrackDuration == nil || *q.TrackDuration {
+			queryDurationHistogram.WithLabelValues(q.jobName, q.Name).Observe(end.Sub(start).Seconds())
+		}
+		start = end
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxResultAge bounds how long unused results are kept
+const maxResultAge = time.Hour
+
+// queryResult holds the rows returned by a query
+type queryResult struct {
+	rows        []map[string]interface{}
+	columns     []string          // column names in the order returned
+	columnTypes map[string]string // column name to the type declared by the database
+	fetched     time.Time
+}
+
+// resultCache shares query results between executions of the same query on
+// the same connection, e.g. by several jobs
+type resultCache struct {
+	sync.Mutex
+	entries map[string]*queryResult
+}
+
+var results = &resultCache{entries: make(map[string]*queryResult)}
+
+// get returns the cached result if it is younger than ttl
+func (c *resultCache) get(key string, ttl time.Duration) *queryResult {
+	c.Lock()
+	defer c.Unlock()
+	result, found := c.entries[key]
+	if !found || time.Since(result.fetched) > ttl {
+		return nil
+	}
+	return result
+}
+
+// set stores the result and drops entries nobody asked for in a long time
+func (c *resultCache) set(key string, result *queryResult) {
+	c.Lock()
+	defer c.Unlock()
+	for k, r := range c.entries {
+		if time.Since(r.fetched) > maxResultAge {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = result
+}
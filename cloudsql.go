@@ -5,6 +5,8 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+
+	"github.com/gobwas/glob"
 )
 
 const (
@@ -30,6 +32,8 @@ type CloudSQLUrl struct {
 	Project  string
 	Region   string
 	Instance string
+	// ExcludeDatabases are globs of databases skipped when a database glob is expanded
+	ExcludeDatabases []glob.Glob
 }
 
 func ParseCloudSQLUrl(u string) (*CloudSQLUrl, error) {
@@ -56,9 +60,32 @@ func ParseCloudSQLUrl(u string) (*CloudSQLUrl, error) {
 		Region:   hostParts[1],
 		Instance: hostParts[2],
 	}
+
+	query := urlParsed.Query()
+	if exclude := query.Get("exclude_databases"); exclude != "" {
+		for _, pattern := range strings.Split(exclude, ",") {
+			g, err := glob.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclude_databases pattern %q: %w", pattern, err)
+			}
+			cloudSQLUrl.ExcludeDatabases = append(cloudSQLUrl.ExcludeDatabases, g)
+		}
+		query.Del("exclude_databases")
+		urlParsed.RawQuery = query.Encode()
+	}
 	return cloudSQLUrl, nil
 }
 
+// IsExcluded reports whether the database matches one of the exclude globs
+func (u *CloudSQLUrl) IsExcluded(database string) bool {
+	for _, g := range u.ExcludeDatabases {
+		if g.Match(database) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *CloudSQLUrl) GetConnectionURL(driver, instance, database string) (string, error) {
 	pass, isSet := u.User.Password()
 	if !isSet {
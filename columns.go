@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// How duplicate column names in a result set are handled. The map a row is
+// scanned into can only hold one of them.
+const (
+	DuplicateColumnsWarn   = "warn"
+	DuplicateColumnsError  = "error"
+	DuplicateColumnsRename = "rename"
+)
+
+// duplicateColumns returns the column names that occur more than once
+func duplicateColumns(columns []string) []string {
+	seen := make(map[string]int, len(columns))
+	var duplicates []string
+	for _, column := range columns {
+		seen[column]++
+		if seen[column] == 2 {
+			duplicates = append(duplicates, column)
+		}
+	}
+	return duplicates
+}
+
+// renameDuplicateColumns appends the occurrence to every repeated column
+// name, e.g. id, id_2, id_3, so they can be told apart by position
+func renameDuplicateColumns(columns []string) []string {
+	taken := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		taken[column] = true
+	}
+	seen := make(map[string]int, len(columns))
+	renamed := make([]string, len(columns))
+	for i, column := range columns {
+		seen[column]++
+		renamed[i] = column
+		if seen[column] == 1 {
+			continue
+		}
+		for n := seen[column]; ; n++ {
+			name := column + "_" + strconv.Itoa(n)
+			if !taken[name] {
+				renamed[i] = name
+				taken[name] = true
+				break
+			}
+		}
+	}
+	return renamed
+}
+
+// scanRenamed scans the current row into res under the renamed columns
+func scanRenamed(rows *sqlx.Rows, columns []string, res map[string]interface{}) error {
+	values, err := rows.SliceScan()
+	if err != nil {
+		return err
+	}
+	if len(values) != len(columns) {
+		return fmt.Errorf("row has %d columns, expected %d", len(values), len(columns))
+	}
+	for i, column := range columns {
+		res[column] = values[i]
+	}
+	return nil
+}
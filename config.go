@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/log"
@@ -27,13 +29,13 @@ func getenv(key, defaultVal string) string {
 
 var (
 	metricsPrefix = "sql_exporter"
-	failedScrapes = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: fmt.Sprintf("%s_last_scrape_failed", metricsPrefix),
-			Help: "Failed scrapes",
-		},
-		[]string{"driver", "host", "database", "user", "sql_job", "query"},
-	)
+	// FailedScrapesLabels are all labels the failed scrapes gauge supports,
+	// the configuration may pick a subset of them
+	FailedScrapesLabels = []string{"driver", "host", "database", "user", "connection", "sql_job", "query"}
+	// failedScrapes is created after loading the configuration as its name
+	// and labels are configurable
+	failedScrapes             *prometheus.GaugeVec
+	failedScrapesLabels       []string
 	tmplStart                 = getenv("TEMPLATE_START", "{{")
 	tmplEnd                   = getenv("TEMPLATE_END", "}}")
 	reEnvironmentPlaceholders = regexp.MustCompile(
@@ -43,47 +45,273 @@ var (
 			regexp.QuoteMeta(tmplEnd),
 		),
 	)
+	// registry holds the metrics exposed on the metrics path
+	registry           = prometheus.NewRegistry()
 	QueryMetricsLabels = []string{"sql_job", "query"}
-	queryCounter       = promauto.NewCounterVec(prometheus.CounterOpts{
+	queryCounter       = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
 		Name: fmt.Sprintf("%s_queries_total", metricsPrefix),
 	}, QueryMetricsLabels)
-	failedQueryCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	failedQueryCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
 		Name: fmt.Sprintf("%s_query_failures_total", metricsPrefix),
 	}, QueryMetricsLabels)
+	timestampOutOfWindowCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_timestamp_out_of_window_total", metricsPrefix),
+		Help: "Rows dropped because their timestamp was outside of the accepted window.",
+	}, QueryMetricsLabels)
+	queryValueFailuresCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_value_failures_total", metricsPrefix),
+		Help: "Values dropped from a row because they could not be turned into a metric.",
+	}, []string{"sql_job", "query", "value"})
+	queryScanErrorsCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_scan_errors_total", metricsPrefix),
+		Help: "Rows dropped from the result of a query because they could not be scanned.",
+	}, []string{"sql_job", "query"})
+	queryVariantGauge = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_variant", metricsPrefix),
+		Help: "Which query succeeded on the connection, 0 for the query itself and n for the nth of fallback_queries.",
+	}, []string{"sql_job", "query", "host", "database"})
+	queryValueOutOfRange = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_value_out_of_range", metricsPrefix),
+		Help: "Whether a value of the column was outside of its value_ranges entry in the last run on any connection.",
+	}, []string{"sql_job", "query", "value"})
+	queryActiveSeries = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_active_series", metricsPrefix),
+		Help: "Number of distinct label sets the query currently exposes over all connections.",
+	}, QueryMetricsLabels)
+	querySeriesGauge = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_series", metricsPrefix),
+		Help: "Number of series the query currently exposes, summed over all connections.",
+	}, QueryMetricsLabels)
+	queryRowsProcessedCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_rows_processed_total", metricsPrefix),
+		Help: "Rows returned by the database for the queries, results served from the cache are not counted.",
+	}, QueryMetricsLabels)
+	queryCacheHitsCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_cache_hits_total", metricsPrefix),
+		Help: "Runs of queries that were served from the result cache.",
+	}, QueryMetricsLabels)
+	querySchemaChangedCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_schema_changed_total", metricsPrefix),
+		Help: "Runs of queries that returned different columns than the previous run on the same connection.",
+	}, QueryMetricsLabels)
+	queryRetriesCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_retries_total", metricsPrefix),
+		Help: "Retries of queries after transient errors like deadlocks.",
+	}, QueryMetricsLabels)
+	unexpectedRowsCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+		Name: fmt.Sprintf("%s_query_unexpected_rows_total", metricsPrefix),
+		Help: "Runs of queries with expect_single_row that returned more than one row.",
+	}, QueryMetricsLabels)
+	connectionLastErrorInfo = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_connection_last_error_info", metricsPrefix),
+		Help: "Class of the error the last connection attempt failed with, cleared once connected.",
+	}, []string{"driver", "host", "error_class"})
+	queryInfo = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_info", metricsPrefix),
+		Help: "Always 1, query_sha is a short hash of the SQL run by the query.",
+	}, []string{"sql_job", "query", "query_sha"})
+	jobSkippedQueries = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_job_skipped_queries", metricsPrefix),
+		Help: "Number of queries of the job which are not run, by the reason they are skipped.",
+	}, []string{"sql_job", "reason"})
+	jobConnections = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_job_connections", metricsPrefix),
+		Help: "Number of connections of the job.",
+	}, []string{"sql_job"})
+	jobSuccess = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_job_success", metricsPrefix),
+		Help: "Whether at least min_successful_queries queries succeeded in the last run of the job.",
+	}, []string{"sql_job"})
+	jobScrapeInProgress = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_job_scrape_in_progress", metricsPrefix),
+		Help: "Set to 1 while the job is running its queries.",
+	}, []string{"sql_job"})
+	queryPlanTimeSeconds = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_plan_time_seconds", metricsPrefix),
+		Help: "Planning time of the query reported by the last EXPLAIN ANALYZE.",
+	}, []string{"sql_job", "query", "host", "database"})
+	queryExecTimeSeconds = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_query_exec_time_seconds", metricsPrefix),
+		Help: "Execution time of the query reported by the last EXPLAIN ANALYZE.",
+	}, []string{"sql_job", "query", "host", "database"})
+	connectionProbeSuccess = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_connection_probe_success", metricsPrefix),
+		Help: "Whether the last connectivity probe of /healthz succeeded.",
+	}, []string{"driver", "host", "database"})
+	connectionProbeDuration = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_connection_probe_duration_seconds", metricsPrefix),
+		Help: "Duration of the last connectivity probe of /healthz.",
+	}, []string{"driver", "host", "database"})
+	failoverActive = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_failover_active", metricsPrefix),
+		Help: "Set to 1 for the connection of a failover group which is currently queried.",
+	}, []string{"sql_job", "failover_group", "driver", "host", "database", "connection"})
+	connectionTokenExpiry = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_connection_token_expiry_seconds", metricsPrefix),
+		Help: "Seconds until the authentication token of the connection expires, negative once expired.",
+	}, []string{"driver", "host"})
+	connectionInsecure = promauto.With(registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_connection_insecure", metricsPrefix),
+		Help: "Set to 1 for connections which do not verify the TLS certificate of the server.",
+	}, []string{"driver", "host"})
+	configReloadSuccess = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_config_last_reload_successful", metricsPrefix),
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadAttemptSeconds = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_config_last_reload_attempt_timestamp_seconds", metricsPrefix),
+		Help: "Timestamp of the last configuration reload attempt, successful or not.",
+	})
+	configReloadSeconds = promauto.With(registry).NewGauge(prometheus.GaugeOpts{
+		Name: fmt.Sprintf("%s_config_last_reload_success_timestamp_seconds", metricsPrefix),
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+	collectTruncatedDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_collect_truncated", metricsPrefix),
+		"Whether the last collection hit the collect timeout and returned only part of the metrics.",
+		nil, nil,
+	)
 
 	// Those are the default buckets
 	DefaultQueryDurationHistogramBuckets = prometheus.DefBuckets
 	// To make the buckets configurable lets init it after loading the configuration.
 	queryDurationHistogram *prometheus.HistogramVec
-)
 
-func init() {
-	prometheus.MustRegister(failedScrapes)
-}
+	// DefaultMinInterval is the lowest interval a periodic job is run at
+	DefaultMinInterval = time.Second
+	// minInterval may be overridden by the configuration
+	minInterval = DefaultMinInterval
+
+	// lintUnits enables the warnings about metric names without unit suffix
+	lintUnits bool
+
+	// externalLabels are added to the metrics of all queries
+	externalLabels map[string]string
+)
 
 // Read attempts to parse the given config and return a file
 // object
 func Read(path string) (File, error) {
 	f := File{}
 
-	fh, err := os.Open(path)
+	buf, err := readConfig(path)
 	if err != nil {
 		return f, err
 	}
-	defer fh.Close()
 
-	buf, err := io.ReadAll(fh)
+	processedConfig, err := replaceEnvironmentPlaceholders(string(buf))
 	if err != nil {
 		return f, err
 	}
 
-	placeholders := reEnvironmentPlaceholders.FindAllString(string(buf), -1)
+	if err := yaml.Unmarshal([]byte(processedConfig), &f); err != nil {
+		return f, err
+	}
+	if slices.ContainsFunc(f.Jobs, func(job *Job) bool { return job != nil && job.EnvPrefix != "" }) {
+		if err := f.replacePrefixedPlaceholders(string(buf)); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// rawConnection is the name and url of a connection before the placeholders
+// are replaced
+type rawConnection struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// UnmarshalYAML accepts a plain connection URL as well as an object
+func (c *rawConnection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.URL); err == nil {
+		return nil
+	}
+	type plain rawConnection
+	return unmarshal((*plain)(c))
+}
+
+// replacePrefixedPlaceholders resolves the placeholders of the connection
+// urls and names and of the startup SQL of jobs with an env_prefix again,
+// the environment variables with the prefix take precedence over those
+// without. The global replacement already resolved them, so they are taken
+// from the raw config.
+func (f *File) replacePrefixedPlaceholders(raw string) error {
+	// the placeholders are replaced by tokens first, so the YAML stays valid
+	// whether they are quoted or not
+	var tokens []string
+	tokenized := reEnvironmentPlaceholders.ReplaceAllStringFunc(raw, func(placeholder string) string {
+		token := fmt.Sprintf("sqlexporterplaceholder%dx", len(tokens)/2)
+		tokens = append(tokens, token, placeholder)
+		return token
+	})
+	restore := strings.NewReplacer(tokens...)
+	var unresolved struct {
+		Jobs []*struct {
+			Connections []rawConnection `yaml:"connections"`
+			StartupSQL  []string        `yaml:"startup_sql"`
+		} `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal([]byte(tokenized), &unresolved); err != nil {
+		return err
+	}
+	for i, job := range f.Jobs {
+		if job == nil || job.EnvPrefix == "" || i >= len(unresolved.Jobs) || unresolved.Jobs[i] == nil {
+			continue
+		}
+		resolve := func(s string) (string, error) {
+			s, err := replacePlaceholders(restore.Replace(s), job.EnvPrefix)
+			if err != nil {
+				return "", err
+			}
+			return replaceEnvironmentPlaceholders(s)
+		}
+		var err error
+		rawJob := unresolved.Jobs[i]
+		for k, cc := range rawJob.Connections {
+			// connections given by fields have no url of their own
+			if k >= len(job.Connections) || cc.URL == "" {
+				continue
+			}
+			if job.Connections[k].URL, err = resolve(cc.URL); err != nil {
+				return fmt.Errorf("job %q: %w", job.Name, err)
+			}
+			if job.Connections[k].Name, err = resolve(cc.Name); err != nil {
+				return fmt.Errorf("job %q: %w", job.Name, err)
+			}
+		}
+		for k, query := range rawJob.StartupSQL {
+			if k >= len(job.StartupSQL) {
+				break
+			}
+			if job.StartupSQL[k], err = resolve(query); err != nil {
+				return fmt.Errorf("job %q: %w", job.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// replaceEnvironmentPlaceholders substitutes all placeholders with the
+// value of the environment variable of the same name. Placeholders without
+// a matching variable are left untouched.
+func replaceEnvironmentPlaceholders(content string) (string, error) {
+	return replacePlaceholders(content, "")
+}
+
+// replacePlaceholders is replaceEnvironmentPlaceholders with the names of the
+// environment variables prefixed with prefix
+func replacePlaceholders(content, prefix string) (string, error) {
+	placeholders := reEnvironmentPlaceholders.FindAllString(content, -1)
 	replacer := strings.NewReplacer(tmplStart, "", tmplEnd, "")
 	var replacements []string
 	for _, placeholder := range placeholders {
 		environmentVariableName := strings.TrimSpace(
 			strings.ToUpper(replacer.Replace(placeholder)),
 		)
+		if environmentVariableName != "" {
+			environmentVariableName = strings.ToUpper(prefix) + environmentVariableName
+		}
 		environmentVariableValue := os.Getenv(environmentVariableName)
 
 		// We extracted a placeholder and found the value in the env variables to replace it with
@@ -93,15 +321,10 @@ func Read(path string) (File, error) {
 		}
 	}
 	if len(replacements)%2 == 1 {
-		return f, errors.New("uneven amount of replacement arguments")
+		return "", errors.New("uneven amount of replacement arguments")
 	}
 	replacerSecrets := strings.NewReplacer(replacements...)
-	processedConfig := replacerSecrets.Replace(string(buf))
-
-	if err := yaml.Unmarshal([]byte(processedConfig), &f); err != nil {
-		return f, err
-	}
-	return f, nil
+	return replacerSecrets.Replace(content), nil
 }
 
 // CloudSQLConfig is required for configuring the cloudsql connections.
@@ -121,7 +344,23 @@ type File struct {
 }
 
 type Configuration struct {
-	HistogramBuckets []float64 `yaml:"histogram_buckets"`
+	LastScrapeFailed MetricConfig      `yaml:"last_scrape_failed"`
+	HistogramBuckets []float64         `yaml:"histogram_buckets"`
+	MinInterval      time.Duration     `yaml:"min_interval"`       // jobs with a smaller interval are clamped to it
+	CollectTimeout   time.Duration     `yaml:"collect_timeout"`    // overall deadline for a single scrape, 0 disables it
+	LintUnits        bool              `yaml:"lint_units"`         // warn about metric names without a unit suffix
+	ExternalLabels   map[string]string `yaml:"external_labels"`    // const labels added to the metrics of all queries
+	Warmup           bool              `yaml:"warmup"`             // connect to all databases before the jobs are started
+	WarmupTimeout    time.Duration     `yaml:"warmup_timeout"`     // give up waiting for the warmup after this long
+	OutputFile       *OutputFileConfig `yaml:"output_file"`        // also write the metrics to a file after every run
+	MetricsTTL       time.Duration     `yaml:"metrics_ttl"`        // drop cached metrics of connections not updated for this long
+	MaxCachedMetrics int               `yaml:"max_cached_metrics"` // drop the oldest cached metrics beyond this many
+}
+
+// MetricConfig overrides the name and the labels of an operational metric
+type MetricConfig struct {
+	Name   string   `yaml:"name"`
+	Labels []string `yaml:"labels"`
 }
 
 type cronConfig struct {
@@ -143,40 +382,235 @@ func (c *cronConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // Job is a collection of connections and queries
 type Job struct {
-	log          log.Logger
-	conns        []*connection
-	Name         string        `yaml:"name"`          // name of this job
-	KeepAlive    bool          `yaml:"keepalive"`     // keep connection between runs?
-	Interval     time.Duration `yaml:"interval"`      // interval at which this job is run
-	CronSchedule cronConfig    `yaml:"cron_schedule"` // if specified, the interval is ignored and the job will be executed at the specified time in CRON syntax
-	Connections  []string      `yaml:"connections"`
-	Queries      []*Query      `yaml:"queries"`
-	StartupSQL   []string      `yaml:"startup_sql"` // SQL executed on startup
+	log                    log.Logger
+	conns                  []*connection
+	queries                map[string]string // named queries of the configuration
+	connectionsFileLoaded  bool
+	connsLock              sync.RWMutex             // held while conns is replaced by a refresh
+	dynamicConns           map[string][]*connection // connections fetched by connections_command or connections_url by URL
+	connectionsRefreshed   time.Time
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	running                sync.Mutex              // held while the job is executed
+	cronEntry              cron.EntryID            // set if the job is scheduled by cron
+	consecutiveFailures    int                     // runs failed in a row
+	statusLock             sync.Mutex              // guards the status of the last run
+	lastRun                time.Time               // start of the last run
+	lastRunFinished        time.Time               // end of the last run
+	lastError              string                  // error of the last run, empty if it succeeded
+	lastWebhook            time.Time               // last call of the on_failure_webhook
+	Name                   string                  `yaml:"name"`          // name of this job
+	EnvPrefix              string                  `yaml:"env_prefix"`    // prefix of the environment variables for placeholders left unresolved
+	KeepAlive              bool                    `yaml:"keepalive"`     // keep connection between runs?
+	Interval               time.Duration           `yaml:"interval"`      // interval at which this job is run
+	CronSchedule           cronConfig              `yaml:"cron_schedule"` // if specified, the interval is ignored and the job will be executed at the specified time in CRON syntax
+	Connections            []ConnectionConfig      `yaml:"connections"`
+	ConnectionsFile        string                  `yaml:"connections_file"`         // file with additional connections, one per line
+	ConnectionsCommand     []string                `yaml:"connections_command"`      // command printing additional connections, one per line
+	ConnectionsURL         string                  `yaml:"connections_url"`          // URL returning additional connections, one per line
+	ConnectionsRefresh     time.Duration           `yaml:"connections_refresh"`      // how often connections_command or connections_url are fetched again
+	MaxParallelConnections int                     `yaml:"max_parallel_connections"` // limit the connections queried at the same time, all by default
+	ConnMaxLifetime        time.Duration           `yaml:"conn_max_lifetime"`        // close connections after this long, negative keeps them forever
+	ConnMaxIdleTime        time.Duration           `yaml:"conn_max_idle_time"`       // close connections idle for this long
+	NormalizeHostLabel     bool                    `yaml:"normalize_host_label"`     // append the default port of the driver to host labels without port
+	RoleSuffix             bool                    `yaml:"role_suffix"`              // append the role of the connection to the metric names instead of a label
+	RoleLabel              string                  `yaml:"role_label"`               // label carrying the role of the connection on all metrics
+	AllowedStatements      []string                `yaml:"allowed_statements"`       // leading keywords the statements of the queries may have, any if empty
+	OnFailureWebhook       string                  `yaml:"on_failure_webhook"`       // URL to POST to after failure_threshold consecutive failed runs
+	MinSuccessfulQueries   int                     `yaml:"min_successful_queries"`   // queries which must succeed for sql_exporter_job_success, defaults to 1
+	FailureThreshold       int                     `yaml:"failure_threshold"`        // consecutive failed runs before the webhook is called, defaults to 3
+	WebhookInterval        time.Duration           `yaml:"webhook_interval"`         // minimum time between two webhook calls, defaults to an hour
+	TLS                    *TLSConfig              `yaml:"tls"`                      // TLS settings for postgres and mysql connections
+	Timezone               string                  `yaml:"timezone"`                 // session time zone of postgres and mysql connections
+	BatchQueries           bool                    `yaml:"batch_queries"`            // send the queries of a connection in one round-trip where the driver supports it
+	ConnectionLabels       *ConnectionLabelsConfig `yaml:"connection_labels"`        // query run on every connection whose result is added as labels
+	RunOn                  []string                `yaml:"run_on"`                   // shards of the exporters running the job, all if empty
+	Charset                string                  `yaml:"charset"`                  // connection charset of mysql connections, e.g. utf8mb4
+	Collation              string                  `yaml:"collation"`                // connection collation of mysql connections
+	Queries                []*Query                `yaml:"queries"`
+	StartupSQL             []string                `yaml:"startup_sql"`  // SQL executed on startup
+	ShutdownSQL            []string                `yaml:"shutdown_sql"` // SQL executed before a connection is closed
+}
+
+// ConnectionConfig is a connection URL with an optional human readable name,
+// it can be written as a plain URL or as an object
+type ConnectionConfig struct {
+	Name     string `yaml:"name"` // exposed as the connection label
+	URL      string `yaml:"url"`
+	Database string `yaml:"database"` // overrides the database label parsed from the URL
+	// connections of the same failover group are tried in order and only the
+	// first one available is queried
+	FailoverGroup string       `yaml:"failover_group"`
+	Role          string       `yaml:"role"`   // value of the role_label of the job, e.g. primary or replica
+	Athena        AthenaConfig `yaml:"athena"` // parameters of athena:// connections
+	// instead of url, the connection can be given by fields which are
+	// assembled into the URL of the driver
+	Driver      string            `yaml:"driver"` // postgres, mysql, sqlserver, clickhouse+tcp, clickhouse+http, snowflake or vertica
+	Host        string            `yaml:"host"`   // the account for snowflake
+	Port        int               `yaml:"port"`
+	User        string            `yaml:"user"`
+	PasswordEnv string            `yaml:"password_env"` // environment variable holding the password
+	Params      map[string]string `yaml:"params"`       // driver specific parameters
+}
+
+// UnmarshalYAML accepts a plain connection URL as well as an object
+func (c *ConnectionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.URL); err == nil {
+		c.Name = ""
+		return nil
+	}
+	type plain ConnectionConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return fmt.Errorf("invalid connection, must be a URL or an object with name and url: %w", err)
+	}
+	if c.URL != "" && c.Driver != "" {
+		return fmt.Errorf("connection %q: only one of url and driver may be set", c.Name)
+	}
+	if c.Driver != "" {
+		u, err := c.buildURL()
+		if err != nil {
+			return fmt.Errorf("connection %q: %w", c.Name, err)
+		}
+		c.URL = u
+	}
+	if c.URL == "" {
+		return fmt.Errorf("connection %q has no url", c.Name)
+	}
+	return nil
+}
+
+// LabelConfig exposes a column as a label, it can be written as the column
+// name, which is then the label name as well, or as an object renaming it
+type LabelConfig struct {
+	Column string `yaml:"column"`
+	Label  string `yaml:"label"` // defaults to the column name
+}
+
+// UnmarshalYAML accepts a plain column name as well as an object
+func (l *LabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&l.Column); err == nil {
+		l.Label = l.Column
+		return nil
+	}
+	type plain LabelConfig
+	if err := unmarshal((*plain)(l)); err != nil {
+		return fmt.Errorf("invalid label, must be a column name or an object with column and label: %w", err)
+	}
+	if l.Column == "" {
+		return fmt.Errorf("label %q has no column", l.Label)
+	}
+	if l.Label == "" {
+		l.Label = l.Column
+	}
+	return nil
 }
 
 type connection struct {
-	conn                *sqlx.DB
+	connecting          sync.Mutex              // held while connecting, e.g. by the warmup
+	conn                atomic.Pointer[sqlx.DB] // nil while not connected, read by scrapes and probes, too
+	name                string
+	failoverGroup       string
+	role                string
 	url                 string
 	driver              string
 	host                string
 	database            string
 	user                string
+	awsRegion           string // region of RDS connections using IAM authentication
 	tokenExpirationTime time.Time
+	certsModified       time.Time         // latest modification of the certificate files of postgres connections
+	labels              map[string]string // result of the connection_labels query of the job
+	stmtsLock           sync.Mutex
+	stmts               map[string]*sqlx.Stmt // prepared statements by query, nil if preparing failed
 }
 
+// Scopes of a query
+const (
+	ScopeAll    = "all"
+	ScopeAnyOne = "any_one"
+)
+
+// Reasons for skipping a query, exposed by sql_exporter_job_skipped_queries
+const (
+	SkipEmpty         = "empty"          // the query is empty
+	SkipUnresolvedRef = "unresolved_ref" // query_ref is not in the queries map
+	SkipNilDesc       = "nil_desc"       // the query could not be initialized yet, it's retried
+	SkipDuplicateName = "duplicate_name" // another query of the job has the same name
+	SkipInvalid       = "invalid"        // the configuration of the query is invalid
+	SkipNotAllowed    = "not_allowed"    // a statement of the query is not in allowed_statements
+)
+
+var skipReasons = []string{SkipEmpty, SkipUnresolvedRef, SkipNilDesc, SkipDuplicateName, SkipInvalid, SkipNotAllowed}
+
+// Types of a query
+const (
+	TypeQuery = "query"
+	TypeExec  = "exec"
+)
+
 // Query is an SQL query that is executed on a connection
 type Query struct {
 	sync.Mutex
-	log           log.Logger
-	desc          *prometheus.Desc
-	metrics       map[*connection][]prometheus.Metric
-	jobName       string
-	AllowZeroRows bool     `yaml:"allow_zero_rows"`
-	Name          string   `yaml:"name"`      // the prometheus metric name
-	Help          string   `yaml:"help"`      // the prometheus metric help text
-	Labels        []string `yaml:"labels"`    // expose these columns as labels per gauge
-	Values        []string `yaml:"values"`    // expose each of these as a gauge
-	Timestamp     string   `yaml:"timestamp"` // expose as metric timestamp
-	Query         string   `yaml:"query"`     // a literal query
-	QueryRef      string   `yaml:"query_ref"` // references a query in the query map
+	log                log.Logger
+	desc               *prometheus.Desc
+	descs              map[string]*prometheus.Desc     // descriptor per value column
+	valueTypes         map[string]prometheus.ValueType // value type per value column
+	metrics            map[*connection][]prometheus.Metric
+	jobName            string
+	connectionLabels   []string                           // labels set by the connection_labels query of the job
+	suffixRoles        []string                           // roles appended to the metric name, see role_suffix
+	roleLabel          string                             // role_label of the job
+	connectionName     bool                               // the job has named connections, exposed as the connection label
+	explained          map[*connection]time.Time          // last EXPLAIN per connection
+	columns            map[*connection][]string           // columns returned by the last run per connection
+	lastValues         map[*connection]map[string]float64 // values of the last run per connection, see seriesState
+	outOfRange         map[*connection]map[string]bool    // value columns out of range in the last run per connection
+	batchFailures      map[*connection]bool               // connections on which the query is left out of batches
+	helpEstablished    bool                               // the help text was taken from help_column
+	updated            map[*connection]time.Time          // last update of the metrics per connection
+	lastSuccess        time.Time                          // end of the last successful run on any connection
+	redactions         map[string]*regexp.Regexp          // compiled label_redactions
+	invalid            bool                               // the configuration of the query can't be fixed by retrying
+	skipReason         string                             // why an invalid query is skipped, one of skipReasons
+	AllowZeroRows      bool                               `yaml:"allow_zero_rows"`
+	Scope              string                             `yaml:"scope"`                // all (default) or any_one to run on a single connection only
+	Type               string                             `yaml:"type"`                 // query (default) or exec to expose rows_affected and last_insert_id of a statement
+	DuplicateColumns   string                             `yaml:"duplicate_columns"`    // warn (default), error or rename duplicate column names
+	ExpectSingleRow    bool                               `yaml:"expect_single_row"`    // fail the query if it returns more than one row
+	Name               string                             `yaml:"name"`                 // the prometheus metric name
+	Help               string                             `yaml:"help"`                 // the prometheus metric help text
+	HelpColumn         string                             `yaml:"help_column"`          // take the help text from this column of the first row
+	Unit               string                             `yaml:"unit"`                 // appended to the metric name, e.g. seconds
+	Labels             []LabelConfig                      `yaml:"labels"`               // expose these columns as labels per gauge
+	LabelRedactions    map[string]string                  `yaml:"label_redactions"`     // replace the matches of the regular expression in the label value
+	Values             []string                           `yaml:"values"`               // expose each of these as a gauge
+	ValueType          string                             `yaml:"value_type"`           // gauge (default), counter or untyped
+	ValueTypes         map[string]string                  `yaml:"value_types"`          // value type per value column, overrides value_type
+	SeparateMetrics    bool                               `yaml:"separate_metrics"`     // expose every value as its own metric named after the column instead of the col label
+	Deltas             []string                           `yaml:"deltas"`               // value columns exposed as the difference to the previous run
+	Smoothing          map[string]*SmoothingConfig        `yaml:"smoothing"`            // value columns exposed as a moving average
+	ValueRanges        map[string]ValueRange              `yaml:"value_ranges"`         // expected range per value column, see sql_exporter_query_value_out_of_range
+	DeltaOnReset       string                             `yaml:"delta_on_reset"`       // drop (default) or zero negative deltas
+	Aggregate          string                             `yaml:"aggregate"`            // reduce the values of all rows with the same labels: sum, max, min, count or avg
+	JSONColumn         string                             `yaml:"json_column"`          // column holding a JSON document per row
+	JSONPaths          map[string]string                  `yaml:"json_paths"`           // add the field at the JSON path of json_column as this column
+	Timestamp          string                             `yaml:"timestamp"`            // expose as metric timestamp
+	TimestampMaxAge    time.Duration                      `yaml:"timestamp_max_age"`    // rows with older timestamps are dropped
+	TimestampMaxFuture time.Duration                      `yaml:"timestamp_max_future"` // rows with timestamps further in the future are dropped
+	Query              string                             `yaml:"query"`                // a literal query
+	QueryRef           string                             `yaml:"query_ref"`            // references a query in the query map
+	QueryFile          string                             `yaml:"query_file"`           // reads the query from a file, .gz files are decompressed
+	QueryBase64        string                             `yaml:"query_base64"`         // a base64 encoded literal query
+	FallbackQueries    []string                           `yaml:"fallback_queries"`     // tried in order if the previous query refers to an unknown table, column or function
+	AutoLimit          int                                `yaml:"auto_limit"`           // append a dialect specific row limit to the query
+	PreSQL             []string                           `yaml:"pre_sql"`              // executed on the same session right before the query
+	PostSQL            []string                           `yaml:"post_sql"`             // executed after the query to reset the session
+	TrackDuration      *bool                              `yaml:"track_duration"`       // observe the query duration histogram, defaults to true
+	CacheTTL           time.Duration                      `yaml:"cache_ttl"`            // reuse the result of the same query on the same connection for this long
+	QueryRetries       int                                `yaml:"query_retries"`        // retry the query this often on transient errors like deadlocks
+	Prepare            bool                               `yaml:"prepare"`              // prepare the query once per connection and reuse the statement
+	StatementTimeout   time.Duration                      `yaml:"statement_timeout"`    // let the database abort the query after this long
+	ConstLabels        map[string]string                  `yaml:"const_labels"`         // fixed labels, take precedence over external_labels
+	Explain            bool                               `yaml:"explain"`              // periodically run EXPLAIN ANALYZE and expose the timings
+	ExplainInterval    time.Duration                      `yaml:"explain_interval"`     // how often to explain, defaults to an hour
 }
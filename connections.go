@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultConnectionsRefresh is how often the connections of a job are
+	// fetched again from connections_command or connections_url
+	DefaultConnectionsRefresh = 5 * time.Minute
+	// connectionsFetchTimeout bounds the command and the HTTP request
+	connectionsFetchTimeout = 30 * time.Second
+)
+
+// parseConnectionList returns the connections listed one per line, empty
+// lines and lines starting with # are skipped
+func (j *Job) parseConnectionList(content string) ([]ConnectionConfig, error) {
+	var err error
+	// the variables with the prefix of the job take precedence
+	if j.EnvPrefix != "" {
+		if content, err = replacePlaceholders(content, j.EnvPrefix); err != nil {
+			return nil, err
+		}
+	}
+	if content, err = replaceEnvironmentPlaceholders(content); err != nil {
+		return nil, err
+	}
+	var configs []ConnectionConfig
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		configs = append(configs, ConnectionConfig{URL: line})
+	}
+	return configs, nil
+}
+
+// dynamicConnections reports whether the job fetches connections periodically
+func (j *Job) dynamicConnections() bool {
+	return len(j.ConnectionsCommand) > 0 || j.ConnectionsURL != ""
+}
+
+// fetchConnections runs the connections command or requests the connections
+// URL and parses its output
+func (j *Job) fetchConnections() ([]ConnectionConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionsFetchTimeout)
+	defer cancel()
+	var out []byte
+	if len(j.ConnectionsCommand) > 0 {
+		var err error
+		out, err = exec.CommandContext(ctx, j.ConnectionsCommand[0], j.ConnectionsCommand[1:]...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("connections_command failed: %w", err)
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.ConnectionsURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("connections_url failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("connections_url returned %s", resp.Status)
+		}
+		if out, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("connections_url failed: %w", err)
+		}
+	}
+	return j.parseConnectionList(string(out))
+}
+
+// refreshConnections fetches the connections of the job again once the
+// refresh interval passed. Connections which are still listed are kept open,
+// connections which are gone are closed and their metrics are dropped. The
+// current connections are kept if fetching them fails.
+func (j *Job) refreshConnections() {
+	if !j.dynamicConnections() {
+		return
+	}
+	refresh := j.ConnectionsRefresh
+	if refresh <= 0 {
+		refresh = DefaultConnectionsRefresh
+	}
+	if time.Since(j.connectionsRefreshed) < refresh {
+		return
+	}
+	j.connectionsRefreshed = time.Now()
+	configs, err := j.fetchConnections()
+	if err != nil {
+		level.Warn(j.log).Log("msg", "Failed to refresh connections", "err", err)
+		return
+	}
+
+	var dynamic []*connection
+	for _, conns := range j.dynamicConns {
+		dynamic = append(dynamic, conns...)
+	}
+	conns := make([]*connection, 0, len(j.conns))
+	for _, conn := range j.conns {
+		if !slices.Contains(dynamic, conn) {
+			conns = append(conns, conn)
+		}
+	}
+	current := make(map[string][]*connection, len(configs))
+	added := 0
+	for _, cc := range configs {
+		if _, found := current[cc.URL]; found {
+			continue
+		}
+		existing, found := j.dynamicConns[cc.URL]
+		if found {
+			delete(j.dynamicConns, cc.URL)
+		} else {
+			existing = j.connectionsFor(cc)
+			added += len(existing)
+		}
+		current[cc.URL] = existing
+		conns = append(conns, existing...)
+	}
+	removed := 0
+	for _, gone := range j.dynamicConns {
+		for _, conn := range gone {
+			j.forgetConnection(conn)
+			removed++
+		}
+	}
+
+	j.connsLock.Lock()
+	j.conns = conns
+	j.connsLock.Unlock()
+	j.dynamicConns = current
+	if added > 0 || removed > 0 {
+		level.Info(j.log).Log("msg", "Refreshed connections", "added", added, "removed", removed, "connections", len(conns))
+	}
+}
+
+// connectionsFor parses a connection config without adding the connections
+// to the job
+func (j *Job) connectionsFor(cc ConnectionConfig) []*connection {
+	added := j.parseConnection(cc)
+	for _, conn := range added {
+		if cc.Database != "" {
+			conn.database = cc.Database
+		}
+		conn.failoverGroup = cc.FailoverGroup
+		conn.role = cc.Role
+		if j.NormalizeHostLabel {
+			conn.host = normalizeHost(conn.driver, conn.host)
+		}
+	}
+	return added
+}
+
+// forgetConnection closes a connection which was removed from the job and
+// drops everything exported for it
+func (j *Job) forgetConnection(conn *connection) {
+	conn.close(j)
+	for _, q := range j.Queries {
+		if q == nil {
+			continue
+		}
+		q.Lock()
+		delete(q.metrics, conn)
+		delete(q.columns, conn)
+		delete(q.explained, conn)
+		delete(q.lastValues, conn)
+		delete(q.outOfRange, conn)
+		delete(q.batchFailures, conn)
+		delete(q.updated, conn)
+		q.Unlock()
+	}
+	all := map[string]string{
+		"driver":     conn.driver,
+		"host":       conn.host,
+		"database":   conn.database,
+		"user":       conn.user,
+		"connection": conn.name,
+		"sql_job":    j.Name,
+	}
+	labels := make(prometheus.Labels, len(all))
+	for _, label := range failedScrapesLabels {
+		if value, found := all[label]; found {
+			labels[label] = value
+		}
+	}
+	failedScrapes.DeletePartialMatch(labels)
+	connectionLastErrorInfo.DeletePartialMatch(prometheus.Labels{"driver": conn.driver, "host": conn.host})
+	connectionTokenExpiry.DeletePartialMatch(prometheus.Labels{"driver": conn.driver, "host": conn.host})
+	perConnection := prometheus.Labels{"sql_job": j.Name, "host": conn.host, "database": conn.database}
+	queryPlanTimeSeconds.DeletePartialMatch(perConnection)
+	queryExecTimeSeconds.DeletePartialMatch(perConnection)
+	queryVariantGauge.DeletePartialMatch(perConnection)
+	if conn.failoverGroup != "" {
+		failoverActive.DeletePartialMatch(prometheus.Labels{
+			"sql_job":    j.Name,
+			"driver":     conn.driver,
+			"host":       conn.host,
+			"database":   conn.database,
+			"connection": conn.name,
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnectionLabelsConfig is a query run once on every connection after it
+// connected. The columns of its single row are added as labels to all
+// metrics of the connection, e.g. the server_id the server reports itself.
+type ConnectionLabelsConfig struct {
+	Query  string   `yaml:"query"`
+	Labels []string `yaml:"labels"` // columns used as labels, in this order
+}
+
+// connectionLabelNames returns the names of the labels set by the
+// connection_labels query of the job
+func (j *Job) connectionLabelNames() []string {
+	if j.ConnectionLabels == nil {
+		return nil
+	}
+	return j.ConnectionLabels.Labels
+}
+
+// queryConnectionLabels runs the connection_labels query, columns missing
+// from its result are empty labels
+func queryConnectionLabels(conn *sqlx.DB, cfg *ConnectionLabelsConfig) (map[string]string, error) {
+	rows, err := conn.Queryx(cfg.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("query returned no row")
+	}
+	res := make(map[string]interface{})
+	if err := rows.MapScan(res); err != nil {
+		return nil, err
+	}
+	if rows.Next() {
+		return nil, fmt.Errorf("query returned more than one row")
+	}
+	labels := make(map[string]string, len(cfg.Labels))
+	for _, label := range cfg.Labels {
+		switch v := res[label].(type) {
+		case nil:
+			labels[label] = ""
+		case []uint8:
+			labels[label] = string(v)
+		default:
+			labels[label] = fmt.Sprint(v)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+// What to do with a negative delta, i.e. after the counter was reset
+const (
+	DeltaResetDrop = "drop"
+	DeltaResetZero = "zero"
+)
+
+// isDelta reports whether the value column is exposed as a delta
+func (q *Query) isDelta(valueName string) bool {
+	for _, d := range q.Deltas {
+		if d == valueName {
+			return true
+		}
+	}
+	return false
+}
+
+// delta returns the difference of the value to the one of the previous run
+// and whether it should be exposed. There is no delta on the first run.
+func (q *Query) delta(s *seriesState, valueName string, labels []string, value float64) (float64, bool) {
+	key := seriesKey(valueName, labels)
+	s.current[key] = value
+	previous, found := s.previous[key]
+	if !found {
+		return 0, false
+	}
+	delta := value - previous
+	if delta < 0 {
+		if q.DeltaOnReset != DeltaResetZero {
+			return 0, false
+		}
+		delta = 0
+	}
+	return delta, true
+}
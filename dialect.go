@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// limitCount matches a row count or offset of a limiting clause
+const limitCount = `(\d+|\?|\$\d+|:\w+)`
+
+var (
+	// reTrailingLimit matches a limiting clause at the end of a query. The
+	// row count may be a number, ALL or a placeholder (?, $1 or :name).
+	reTrailingLimit = regexp.MustCompile(`(?is)\b(limit\s+(all|` + limitCount + `)(\s*,\s*` + limitCount + `|\s+offset\s+` + limitCount + `)?|fetch\s+(first|next)\s+(` + limitCount + `\s+)?rows?\s+only)\s*$`)
+	// reSelectTop matches the start of a MS-SQL query, up to where TOP goes
+	reSelectTop = regexp.MustCompile(`(?is)^(\s*select\s+(?:distinct\s+)?)(top\b)?`)
+	// reSelect matches the SELECT keyword at the start of a query
+	reSelect = regexp.MustCompile(`(?is)^\s*select\b`)
+)
+
+// limitQuery returns the query with a row limit for the dialect of the
+// driver. If the query already limits its rows it is returned as is. Only
+// queries of a single SELECT or WITH statement can be limited.
+func limitQuery(driver, query string, limit int) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	if keywords := statementKeywords(query); len(keywords) != 1 || (keywords[0] != "select" && keywords[0] != "with") {
+		return "", fmt.Errorf("only queries of a single SELECT or WITH statement can be limited")
+	}
+	switch driver {
+	case "postgres", "mysql", "clickhouse", "clickhouse+tcp", "clickhouse+http", "vertica", "snowflake", "athena", CLOUDSQL_POSTGRES, CLOUDSQL_MYSQL:
+		if reTrailingLimit.MatchString(query) {
+			return query, nil
+		}
+		return fmt.Sprintf("%s\nLIMIT %d", query, limit), nil
+	case "sqlserver", "mssql":
+		m := reSelectTop.FindStringSubmatch(query)
+		if m == nil {
+			return "", fmt.Errorf("only plain SELECT queries can be limited for %s", driver)
+		}
+		if m[2] != "" || reTrailingLimit.MatchString(query) {
+			return query, nil
+		}
+		return fmt.Sprintf("%sTOP %d %s", m[1], limit, query[len(m[1]):]), nil
+	}
+	return "", fmt.Errorf("driver %s does not support automatic limits", driver)
+}
+
+// statementTimeout returns how the database enforces the timeout for the
+// dialect of the driver. Either setup is a statement to execute in the
+// transaction of the query or the returned query carries the timeout itself.
+func statementTimeout(driver, query string, timeout time.Duration) (setup string, limited string, err error) {
+	ms := timeout.Milliseconds()
+	switch driver {
+	case "postgres", CLOUDSQL_POSTGRES:
+		return fmt.Sprintf("SET LOCAL statement_timeout = %d", ms), query, nil
+	case "mysql", CLOUDSQL_MYSQL:
+		m := reSelect.FindString(query)
+		if m == "" {
+			return "", "", fmt.Errorf("only SELECT queries can be limited for %s", driver)
+		}
+		return "", fmt.Sprintf("%s /*+ MAX_EXECUTION_TIME(%d) */%s", m, ms, query[len(m):]), nil
+	}
+	return "", "", fmt.Errorf("driver %s does not support statement timeouts", driver)
+}
+
+// defaultPorts are the ports the drivers connect to if the URL has none
+var defaultPorts = map[string]string{
+	"postgres":        "5432",
+	"mysql":           "3306",
+	"sqlserver":       "1433",
+	"vertica":         "5433",
+	"clickhouse":      "9000",
+	"clickhouse+tcp":  "9000",
+	"clickhouse+http": "8123",
+}
+
+// normalizeHost appends the default port of the driver to the host if it has
+// none. Hosts which aren't plain host names, e.g. lists of hosts or named
+// MS-SQL instances, are returned as is.
+func normalizeHost(driver, host string) string {
+	port, found := defaultPorts[driver]
+	if !found || host == "" || strings.ContainsAny(host, ",\\/") {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
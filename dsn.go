@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// buildURL assembles the connection URL of the driver from the individual
+// fields of a connection, so the DSN syntax of every driver doesn't have to
+// be known
+func (c *ConnectionConfig) buildURL() (string, error) {
+	password := ""
+	if c.PasswordEnv != "" {
+		var found bool
+		if password, found = os.LookupEnv(c.PasswordEnv); !found {
+			return "", fmt.Errorf("environment variable %s of password_env is not set", c.PasswordEnv)
+		}
+	}
+	host := c.Host
+	if c.Port != 0 {
+		host = net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	}
+	params := url.Values{}
+	for key, value := range c.Params {
+		params.Set(key, value)
+	}
+	var user *url.Userinfo
+	if c.User != "" {
+		user = url.User(c.User)
+		if password != "" {
+			user = url.UserPassword(c.User, password)
+		}
+	}
+	u := &url.URL{Scheme: c.Driver, User: user, Host: host}
+	switch c.Driver {
+	case "postgres", "vertica", "clickhouse+tcp", "clickhouse+http", "snowflake":
+		// the host of snowflake is the account
+		if c.Database != "" {
+			u.Path = "/" + c.Database
+		}
+	case "sqlserver":
+		if c.Database != "" {
+			params.Set("database", c.Database)
+		}
+	case "mysql":
+		if c.Port == 0 {
+			host = net.JoinHostPort(c.Host, defaultPorts["mysql"])
+		}
+		cfg := mysql.NewConfig()
+		cfg.User = c.User
+		cfg.Passwd = password
+		cfg.Net = "tcp"
+		cfg.Addr = host
+		cfg.DBName = c.Database
+		if len(c.Params) > 0 {
+			cfg.Params = c.Params
+		}
+		return "mysql://" + cfg.FormatDSN(), nil
+	default:
+		return "", fmt.Errorf("driver %q can't be configured by fields, use url", c.Driver)
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseDuration accepts durations like 30s or 5m as well as a whole number
+// of seconds. yaml.v2 itself takes a bare number as nanoseconds, which is
+// never what was meant.
+func parseDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid duration %v, must be like 30s or 5m or a whole number of seconds", value)
+}
+
+// unmarshalWithDurations decodes the YAML mapping into out and then sets the
+// given duration fields with parseDuration
+func unmarshalWithDurations(unmarshal func(interface{}) error, out interface{}, fields map[string]*time.Duration) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	durations := make(map[*time.Duration]time.Duration, len(fields))
+	for key, field := range fields {
+		value, found := raw[key]
+		if !found || value == nil {
+			continue
+		}
+		d, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		durations[field] = d
+	}
+	if err := unmarshal(out); err != nil {
+		return err
+	}
+	for field, d := range durations {
+		*field = d
+	}
+	return nil
+}
+
+// UnmarshalYAML reads the durations of the configuration with parseDuration
+func (c *Configuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Configuration
+	return unmarshalWithDurations(unmarshal, (*plain)(c), map[string]*time.Duration{
+		"min_interval":    &c.MinInterval,
+		"collect_timeout": &c.CollectTimeout,
+		"warmup_timeout":  &c.WarmupTimeout,
+		"metrics_ttl":     &c.MetricsTTL,
+	})
+}
+
+// UnmarshalYAML reads the durations of the job with parseDuration
+func (j *Job) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Job
+	return unmarshalWithDurations(unmarshal, (*plain)(j), map[string]*time.Duration{
+		"interval":            &j.Interval,
+		"connections_refresh": &j.ConnectionsRefresh,
+		"conn_max_lifetime":   &j.ConnMaxLifetime,
+		"conn_max_idle_time":  &j.ConnMaxIdleTime,
+		"webhook_interval":    &j.WebhookInterval,
+	})
+}
+
+// UnmarshalYAML reads the durations of the query with parseDuration
+func (q *Query) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Query
+	return unmarshalWithDurations(unmarshal, (*plain)(q), map[string]*time.Duration{
+		"timestamp_max_age":    &q.TimestampMaxAge,
+		"timestamp_max_future": &q.TimestampMaxFuture,
+		"cache_ttl":            &q.CacheTTL,
+		"statement_timeout":    &q.StatementTimeout,
+		"explain_interval":     &q.ExplainInterval,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// error classes exposed by the connection error metric, keep this set small
+// as it is used as a label value
+const (
+	errorClassAuth    = "auth"
+	errorClassTimeout = "timeout"
+	errorClassDNS     = "dns"
+	errorClassTLS     = "tls"
+	errorClassOther   = "other"
+)
+
+// classifyError maps a connection error to one of a few error classes
+func classifyError(err error) string {
+	var (
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		pqErr        *pq.Error
+		mysqlErr     *mysql.MySQLError
+		mssqlErr     mssql.Error
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return errorClassDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout
+	case errors.As(err, &recordErr), errors.As(err, &verifyErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return errorClassTLS
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "28",
+		errors.As(err, &mysqlErr) && (mysqlErr.Number == 1044 || mysqlErr.Number == 1045),
+		errors.As(err, &mssqlErr) && mssqlErr.Number == 18456:
+		return errorClassAuth
+	}
+
+	// not every driver returns typed errors, so fall back to the message
+	msg := strings.ToLower(err.Error())
+	switch {
+	case containsAny(msg, "authentication failed", "access denied", "login failed", "incorrect username or password", "invalid password"):
+		return errorClassAuth
+	case containsAny(msg, "no such host", "server misbehaving"):
+		return errorClassDNS
+	case containsAny(msg, "timeout", "timed out"):
+		return errorClassTimeout
+	case containsAny(msg, "tls", "x509", "certificate", "ssl"):
+		return errorClassTLS
+	}
+	return errorClassOther
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUndefinedObject reports whether a query failed because it refers to a
+// table, column or function the database doesn't have
+func isUndefinedObject(err error) bool {
+	var (
+		pqErr    *pq.Error
+		mysqlErr *mysql.MySQLError
+		mssqlErr mssql.Error
+	)
+	switch {
+	case errors.As(err, &pqErr):
+		// undefined_table, undefined_column, undefined_function and undefined_object
+		return pqErr.Code == "42P01" || pqErr.Code == "42703" || pqErr.Code == "42883" || pqErr.Code == "42704"
+	case errors.As(err, &mysqlErr):
+		// ER_NO_SUCH_TABLE, ER_BAD_FIELD_ERROR and ER_SP_DOES_NOT_EXIST
+		return mysqlErr.Number == 1146 || mysqlErr.Number == 1054 || mysqlErr.Number == 1305
+	case errors.As(err, &mssqlErr):
+		// invalid object name and invalid column name
+		return mssqlErr.Number == 208 || mssqlErr.Number == 207
+	}
+	// not every driver returns typed errors, so fall back to the message
+	msg := strings.ToLower(err.Error())
+	return containsAny(msg, "does not exist", "unknown column", "no such table", "no such column", "invalid object name", "cannot be resolved")
+}
+
+// isTransient reports whether a query failed because of contention with other
+// transactions, e.g. a deadlock, so running it again will likely succeed
+func isTransient(err error) bool {
+	var (
+		pqErr    *pq.Error
+		mysqlErr *mysql.MySQLError
+		mssqlErr mssql.Error
+	)
+	switch {
+	case errors.As(err, &pqErr):
+		// serialization_failure and deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	case errors.As(err, &mysqlErr):
+		// ER_LOCK_DEADLOCK and ER_LOCK_WAIT_TIMEOUT
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	case errors.As(err, &mssqlErr):
+		// chosen as deadlock victim
+		return mssqlErr.Number == 1205
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// evictionInterval is how often the cached metrics are checked for eviction
+const evictionInterval = time.Minute
+
+// Reasons for evicting cached metrics
+const (
+	EvictTTL = "ttl" // the connection didn't update them for metrics_ttl
+	EvictCap = "cap" // there were more than max_cached_metrics
+)
+
+var metricsEvictedCounter = promauto.With(registry).NewCounterVec(prometheus.CounterOpts{
+	Name: fmt.Sprintf("%s_metrics_evicted_total", metricsPrefix),
+	Help: "Cached metrics dropped before being replaced by a new run, by reason.",
+}, []string{"reason"})
+
+// cachedMetrics are the metrics of a query from a connection
+type cachedMetrics struct {
+	query   *Query
+	conn    *connection
+	updated time.Time
+	count   int
+}
+
+// evictPeriodically evicts cached metrics, it never returns
+func (e *Exporter) evictPeriodically() {
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		e.evictMetrics(now)
+	}
+}
+
+// evictMetrics drops the cached metrics of connections which did not update
+// them for metrics_ttl, e.g. because the connection is gone, and the oldest
+// ones while there are more than max_cached_metrics
+func (e *Exporter) evictMetrics(now time.Time) {
+	e.RLock()
+	jobs := e.jobs
+	ttl, limit := e.metricsTTL, e.maxCachedMetrics
+	e.RUnlock()
+	if ttl <= 0 && limit <= 0 {
+		return
+	}
+	var cached []cachedMetrics
+	total := 0
+	for _, job := range jobs {
+		for _, q := range job.Queries {
+			if q == nil {
+				continue
+			}
+			q.Lock()
+			for conn, metrics := range q.metrics {
+				updated := q.updated[conn]
+				if ttl > 0 && now.Sub(updated) > ttl {
+					q.evict(conn)
+					metricsEvictedCounter.WithLabelValues(EvictTTL).Add(float64(len(metrics)))
+					continue
+				}
+				cached = append(cached, cachedMetrics{query: q, conn: conn, updated: updated, count: len(metrics)})
+				total += len(metrics)
+			}
+			q.Unlock()
+		}
+	}
+	if limit <= 0 || total <= limit {
+		return
+	}
+	level.Warn(e.logger).Log("msg", "More cached metrics than max_cached_metrics, evicting the oldest", "cached", total, "max_cached_metrics", limit)
+	sort.Slice(cached, func(i, j int) bool { return cached[i].updated.Before(cached[j].updated) })
+	for _, c := range cached {
+		if total <= limit {
+			break
+		}
+		c.query.Lock()
+		// a run may have replaced them in the meantime
+		if c.query.updated[c.conn].Equal(c.updated) {
+			c.query.evict(c.conn)
+			metricsEvictedCounter.WithLabelValues(EvictCap).Add(float64(c.count))
+			total -= c.count
+		}
+		c.query.Unlock()
+	}
+}
+
+// evict drops the cached metrics of the connection, the caller must hold
+// the lock of the query
+func (q *Query) evict(conn *connection) {
+	delete(q.metrics, conn)
+	delete(q.updated, conn)
+}
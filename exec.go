@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Columns of the single row returned by a query of type exec
+const (
+	rowsAffectedColumn = "rows_affected"
+	lastInsertIDColumn = "last_insert_id"
+)
+
+func (p preparedQueryer) ExecContext(ctx context.Context, _ string, args ...interface{}) (sql.Result, error) {
+	return p.stmt.ExecContext(ctx, args...)
+}
+
+// exec executes a statement of a query of type exec and returns a single row
+// with the rows affected and, if the driver supports it, the last insert ID
+func (q *Query) exec(ctx context.Context, db sqlx.ExecerContext, query string) (*queryResult, error) {
+	now := time.Now()
+	res, err := db.ExecContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if q.TrackDuration == nil || *q.TrackDuration {
+		queryDurationHistogram.WithLabelValues(q.jobName, q.Name).Observe(time.Since(now).Seconds())
+	}
+	row := make(map[string]interface{}, 2)
+	result := &queryResult{fetched: now, rows: []map[string]interface{}{row}}
+	if n, err := res.RowsAffected(); err == nil {
+		row[rowsAffectedColumn] = n
+		result.columns = append(result.columns, rowsAffectedColumn)
+	}
+	// e.g. postgres doesn't support it
+	if id, err := res.LastInsertId(); err == nil {
+		row[lastInsertIDColumn] = id
+		result.columns = append(result.columns, lastInsertIDColumn)
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// DefaultExplainInterval is how often a query with explain is analyzed
+const DefaultExplainInterval = time.Hour
+
+// explainOutput is the result of EXPLAIN (FORMAT JSON) on PostgreSQL, the
+// times are in milliseconds
+type explainOutput []struct {
+	PlanningTime  float64 `json:"Planning Time"`
+	ExecutionTime float64 `json:"Execution Time"`
+}
+
+// explainDue reports whether the query should be analyzed on the connection
+// and marks it as analyzed if so
+func (q *Query) explainDue(conn *connection) bool {
+	interval := q.ExplainInterval
+	if interval <= 0 {
+		interval = DefaultExplainInterval
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.explained == nil {
+		q.explained = make(map[*connection]time.Time)
+	}
+	if time.Since(q.explained[conn]) < interval {
+		return false
+	}
+	q.explained[conn] = time.Now()
+	return true
+}
+
+// explain runs EXPLAIN ANALYZE for the query and exposes the planning and
+// execution time reported by the database. This executes the query once more.
+func (q *Query) explain(conn *connection, query string) error {
+	if conn.driver != "postgres" {
+		level.Debug(q.log).Log("msg", "Explain is only supported on PostgreSQL", "driver", conn.driver)
+		return nil
+	}
+	if !q.explainDue(conn) {
+		return nil
+	}
+	// pre_sql may set the search_path the query depends on
+	var out []byte
+	run := func(ctx context.Context, db txQueryer) error {
+		var err error
+		out, err = q.explainQuery(ctx, db, conn, query)
+		return err
+	}
+	var err error
+	if len(q.PreSQL) > 0 || len(q.PostSQL) > 0 {
+		err = q.inSession(conn, run)
+	} else {
+		err = run(context.Background(), conn.conn.Load())
+	}
+	if err != nil {
+		return err
+	}
+	var plans explainOutput
+	if err := json.Unmarshal(out, &plans); err != nil {
+		return err
+	}
+	if len(plans) == 0 {
+		return fmt.Errorf("empty explain output")
+	}
+	queryPlanTimeSeconds.WithLabelValues(q.jobName, q.Name, conn.host, conn.database).Set(plans[0].PlanningTime / 1000)
+	queryExecTimeSeconds.WithLabelValues(q.jobName, q.Name, conn.host, conn.database).Set(plans[0].ExecutionTime / 1000)
+	return nil
+}
+
+// explainQuery runs EXPLAIN ANALYZE for the query with its statement_timeout
+func (q *Query) explainQuery(ctx context.Context, db txQueryer, conn *connection, query string) ([]byte, error) {
+	explain := "EXPLAIN (ANALYZE, FORMAT JSON) " + query
+	var out []byte
+	if q.StatementTimeout <= 0 {
+		err := db.QueryRowxContext(ctx, explain).Scan(&out)
+		return out, err
+	}
+	setup, _, err := statementTimeout(conn.driver, query, q.StatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, setup); err != nil {
+		return nil, fmt.Errorf("failed to set statement_timeout: %w", err)
+	}
+	err = tx.QueryRowxContext(ctx, explain).Scan(&out)
+	return out, err
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/cloudsqlconn"
 	"cloud.google.com/go/cloudsqlconn/mysql/mysql"
@@ -16,18 +18,27 @@ import (
 	sqladmin "google.golang.org/api/sqladmin/v1beta4"
 )
 
+const defaultConfigFile = "config.yml"
+
 // Exporter collects SQL metrics. It implements prometheus.Collector.
 type Exporter struct {
-	jobs            []*Job
-	logger          log.Logger
-	cronScheduler   *cron.Cron
-	sqladminService *sqladmin.Service
+	sync.RWMutex
+	reloading        sync.Mutex
+	jobs             []*Job
+	logger           log.Logger
+	configFile       string
+	collectTimeout   time.Duration
+	metricsTTL       time.Duration // see evictMetrics
+	maxCachedMetrics int
+	cronScheduler    *cron.Cron
+	sqladminService  *sqladmin.Service
+	ready            chan struct{} // closed once the startup is complete
 }
 
 // NewExporter returns a new SQL Exporter for the provided config.
 func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
 	if configFile == "" {
-		configFile = "config.yml"
+		configFile = defaultConfigFile
 	}
 
 	// read config
@@ -35,6 +46,7 @@ func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.Jobs = selectJobs(logger, cfg.Jobs)
 
 	var queryDurationHistogramBuckets []float64
 	if len(cfg.Configuration.HistogramBuckets) == 0 {
@@ -42,46 +54,44 @@ func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
 	} else {
 		queryDurationHistogramBuckets = cfg.Configuration.HistogramBuckets
 	}
-	queryDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	queryDurationHistogram = promauto.With(registry).NewHistogramVec(prometheus.HistogramOpts{
 		Name:    fmt.Sprintf("%s_query_duration_seconds", metricsPrefix),
 		Help:    "Time spent by querying the database.",
 		Buckets: queryDurationHistogramBuckets,
 	}, QueryMetricsLabels)
 
+	failedScrapes, failedScrapesLabels, err = newFailedScrapes(cfg.Configuration.LastScrapeFailed)
+	if err != nil {
+		return nil, err
+	}
+	if err := registry.Register(failedScrapes); err != nil {
+		return nil, err
+	}
+
+	if cfg.Configuration.MinInterval > 0 {
+		minInterval = cfg.Configuration.MinInterval
+	}
+	lintUnits = cfg.Configuration.LintUnits
+	externalLabels = cfg.Configuration.ExternalLabels
+	output.configure(cfg.Configuration.OutputFile)
+
 	exp := &Exporter{
-		jobs:          make([]*Job, 0, len(cfg.Jobs)),
-		logger:        logger,
-		cronScheduler: cron.New(),
+		jobs:             make([]*Job, 0, len(cfg.Jobs)),
+		logger:           logger,
+		configFile:       configFile,
+		collectTimeout:   cfg.Configuration.CollectTimeout,
+		metricsTTL:       cfg.Configuration.MetricsTTL,
+		maxCachedMetrics: cfg.Configuration.MaxCachedMetrics,
+		cronScheduler:    cron.New(),
+		ready:            make(chan struct{}),
 	}
 
 	if cfg.CloudSQLConfig != nil {
-		if cfg.CloudSQLConfig.KeyFile == "" {
-			return nil, fmt.Errorf("as cloudsql_config is not empty, then cloudsql_config.key_file must be set")
-		}
-
-		// We currently only support keyfile. Additional authentication options would be via automatic IAM
-		//	 with cloudsqlconn.WithIAMAuthN()
-		cloudsqlconnection := cloudsqlconn.WithCredentialsFile(cfg.CloudSQLConfig.KeyFile)
-		sqladminService, err := sqladmin.NewService(context.Background(), option.WithAPIKey(cfg.CloudSQLConfig.KeyFile))
+		sqladminService, err := registerCloudSQLDrivers(cfg.CloudSQLConfig)
 		if err != nil {
-			return nil, fmt.Errorf("could not create new cloud sqladmin service: %w", err)
+			return nil, err
 		}
 		exp.sqladminService = sqladminService
-
-		//
-		// Register all possible cloudsql drivers
-
-		// drop cleanup as we don't really know when to end this
-		_, err = pgxv4.RegisterDriver(CLOUDSQL_POSTGRES, cloudsqlconnection)
-		if err != nil {
-			return nil, fmt.Errorf("could not register cloudsql-postgres driver: %w", err)
-		}
-
-		// drop cleanup as we don't really know when to end this
-		_, err = mysql.RegisterDriver(CLOUDSQL_MYSQL, cloudsqlconnection)
-		if err != nil {
-			return nil, fmt.Errorf("could not register cloudsql-mysql driver: %w", err)
-		}
 	}
 
 	// dispatch all jobs
@@ -95,20 +105,108 @@ func NewExporter(logger log.Logger, configFile string) (*Exporter, error) {
 			continue
 		}
 		exp.jobs = append(exp.jobs, job)
-		if job.CronSchedule.schedule != nil {
-			exp.cronScheduler.Schedule(job.CronSchedule.schedule, job)
-			level.Info(logger).Log("msg", "Scheduled CRON job", "name", job.Name, "cron_schedule", job.CronSchedule.definition)
-		} else {
-			go job.ExecutePeriodically()
-			level.Info(logger).Log("msg", "Started periodically execution of job", "name", job.Name, "interval", job.Interval)
-		}
 	}
-	exp.cronScheduler.Start()
+	exportInsecureConnections(exp.jobs)
+	if cfg.Configuration.Warmup {
+		// the jobs are started once connected, a reload or shutdown has to
+		// wait for that
+		exp.reloading.Lock()
+		go func() {
+			defer exp.reloading.Unlock()
+			warmup(exp.jobs, cfg.Configuration.WarmupTimeout)
+			exp.start()
+		}()
+	} else {
+		exp.start()
+	}
+	go exp.evictPeriodically()
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	configReloadAttemptSeconds.SetToCurrentTime()
 	return exp, nil
 }
 
+// registerCloudSQLDrivers registers the database drivers used for CloudSQL
+// connections, it must be called at most once
+func registerCloudSQLDrivers(cfg *CloudSQLConfig) (*sqladmin.Service, error) {
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("as cloudsql_config is not empty, then cloudsql_config.key_file must be set")
+	}
+
+	// We currently only support keyfile. Additional authentication options would be via automatic IAM
+	//	 with cloudsqlconn.WithIAMAuthN()
+	cloudsqlconnection := cloudsqlconn.WithCredentialsFile(cfg.KeyFile)
+	sqladminService, err := sqladmin.NewService(context.Background(), option.WithAPIKey(cfg.KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not create new cloud sqladmin service: %w", err)
+	}
+
+	//
+	// Register all possible cloudsql drivers
+
+	// drop cleanup as we don't really know when to end this
+	_, err = pgxv4.RegisterDriver(CLOUDSQL_POSTGRES, cloudsqlconnection)
+	if err != nil {
+		return nil, fmt.Errorf("could not register cloudsql-postgres driver: %w", err)
+	}
+
+	// drop cleanup as we don't really know when to end this
+	_, err = mysql.RegisterDriver(CLOUDSQL_MYSQL, cloudsqlconnection)
+	if err != nil {
+		return nil, fmt.Errorf("could not register cloudsql-mysql driver: %w", err)
+	}
+	return sqladminService, nil
+}
+
+// start dispatches all jobs and marks the exporter as ready
+func (e *Exporter) start() {
+	for _, job := range e.jobs {
+		e.startJob(job)
+	}
+	e.cronScheduler.Start()
+	close(e.ready)
+}
+
+func (e *Exporter) startJob(job *Job) {
+	if job.CronSchedule.schedule != nil {
+		job.cronEntry = e.cronScheduler.Schedule(job.CronSchedule.schedule, job)
+		level.Info(e.logger).Log("msg", "Scheduled CRON job", "name", job.Name, "cron_schedule", job.CronSchedule.definition)
+	} else {
+		go job.ExecutePeriodically()
+		level.Info(e.logger).Log("msg", "Started periodically execution of job", "name", job.Name, "interval", job.Interval)
+	}
+}
+
+func (e *Exporter) stopJob(job *Job) {
+	if job.CronSchedule.schedule != nil {
+		e.cronScheduler.Remove(job.cronEntry)
+	}
+	job.stop()
+	level.Info(e.logger).Log("msg", "Stopped job", "name", job.Name)
+}
+
+// Shutdown stops all jobs and closes their connections
+func (e *Exporter) Shutdown() {
+	// a reload must not start new jobs in the meantime
+	e.reloading.Lock()
+	defer e.reloading.Unlock()
+	<-e.cronScheduler.Stop().Done()
+	e.RLock()
+	jobs := e.jobs
+	e.RUnlock()
+	for _, job := range jobs {
+		e.stopJob(job)
+		job.closeConnections()
+	}
+}
+
 // Describe implements prometheus.Collector
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.RLock()
+	defer e.RUnlock()
+	ch <- collectTruncatedDesc
+	ch <- stalenessDesc
+	describePoolStats(ch)
 	for _, job := range e.jobs {
 		if job == nil {
 			continue
@@ -117,17 +215,31 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 			if query == nil {
 				continue
 			}
+			query.Lock()
 			if query.desc == nil {
-				level.Error(e.logger).Log("msg", "Query has no descriptor", "query", query.Name)
+				// not initialized (yet), its metrics are described once it is
+				query.Unlock()
 				continue
 			}
 			ch <- query.desc
+			for _, desc := range query.descs {
+				ch <- desc
+			}
+			query.Unlock()
 		}
 	}
 }
 
 // Collect implements prometheus.Collector
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.RLock()
+	defer e.RUnlock()
+	var deadline time.Time
+	if e.collectTimeout > 0 {
+		deadline = time.Now().Add(e.collectTimeout)
+	}
+	truncated := 0.0
+collect:
 	for _, job := range e.jobs {
 		if job == nil {
 			continue
@@ -138,9 +250,25 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 			}
 			for _, metrics := range query.metrics {
 				for _, metric := range metrics {
+					// a slow consumer must not hold the scrape open forever
+					if !deadline.IsZero() && time.Now().After(deadline) {
+						truncated = 1
+						break collect
+					}
 					ch <- metric
 				}
 			}
 		}
 	}
+	now := time.Now()
+	for _, job := range e.jobs {
+		if job != nil {
+			collectPoolStats(ch, job)
+			collectStaleness(ch, job, now)
+		}
+	}
+	if truncated > 0 {
+		level.Warn(e.logger).Log("msg", "Collect timeout exceeded, returning partial metrics", "timeout", e.collectTimeout)
+	}
+	ch <- prometheus.MustNewConstMetric(collectTruncatedDesc, prometheus.GaugeValue, truncated)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/go-kit/log/level"
+)
+
+// establishHelp takes the help text from the help_column of the first row of
+// the first run which returned rows and prepares the descriptors again with
+// it. The help text doesn't change afterwards, all metrics of a family must
+// share it, so the metrics cached with the configured help are dropped.
+func (q *Query) establishHelp(rows []map[string]interface{}) {
+	if q.HelpColumn == "" || len(rows) == 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.helpEstablished {
+		return
+	}
+	q.helpEstablished = true
+	var help string
+	switch v := rows[0][q.HelpColumn].(type) {
+	case string:
+		help = v
+	case []uint8:
+		help = string(v)
+	}
+	help = strings.TrimSpace(help)
+	if help == "" {
+		level.Warn(q.log).Log("msg", "Help column is empty or not text, keeping the configured help", "column", q.HelpColumn)
+		return
+	}
+	q.initDescs(q.metricName(), help)
+	for conn := range q.metrics {
+		delete(q.metrics, conn)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -37,7 +40,32 @@ var (
 	CloudSQLPrefix = "cloudsql+"
 )
 
-func handleRDSMySQLIAMAuth(conn string) (string, time.Time, error) {
+// shutdownSQLTimeout limits each ShutdownSQL statement, so a hanging database
+// can't block the shutdown
+const shutdownSQLTimeout = 10 * time.Second
+
+// reRDSRegion extracts the region from RDS endpoints like
+// mydb.abc123.eu-west-1.rds.amazonaws.com
+var reRDSRegion = regexp.MustCompile(`\.([a-z0-9-]+)\.rds\.amazonaws\.com(\.cn)?$`)
+
+// rdsRegion returns the AWS region of an RDS connection: the aws_region
+// parameter if given, otherwise the region of the endpoint and finally the
+// AWS_REGION environment variable
+func rdsRegion(param, addr string) string {
+	if param != "" {
+		return param
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if m := reRDSRegion.FindStringSubmatch(host); m != nil {
+		return m[1]
+	}
+	return os.Getenv("AWS_REGION")
+}
+
+func handleRDSMySQLIAMAuth(conn, region string) (string, time.Time, error) {
 	dsn := strings.TrimPrefix(conn, "rds-mysql://")
 	config, err := mysql.ParseDSN(dsn)
 	if err != nil {
@@ -48,7 +76,7 @@ func handleRDSMySQLIAMAuth(conn string) (string, time.Time, error) {
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
-	token, err := rdsutils.BuildAuthToken(config.Addr, os.Getenv("AWS_REGION"), config.User, sess.Config.Credentials)
+	token, err := rdsutils.BuildAuthToken(config.Addr, region, config.User, sess.Config.Credentials)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to build RDS auth token: %v", err)
 	}
@@ -58,9 +86,112 @@ func handleRDSMySQLIAMAuth(conn string) (string, time.Time, error) {
 	return token, expirationTime, nil
 }
 
-// Init will initialize the metric descriptors
+// Init will initialize the metric descriptors and the connections
 func (j *Job) Init(logger log.Logger, queries map[string]string) error {
+	if err := j.loadConnectionsFile(); err != nil {
+		return err
+	}
+	j.init(logger)
+	// the connections are set up first, the help text may refer to them
+	j.updateConnections()
+	jobConnections.WithLabelValues(j.Name).Set(float64(len(j.conns)))
+	// the connections fetched by a command or URL may show up later
+	if len(j.conns) == 0 && !j.dynamicConnections() {
+		return fmt.Errorf("no usable connections, check the connection URLs and globs")
+	}
+	j.initQueries(queries)
+	return nil
+}
+
+// takeOver initializes the job like Init, but reuses the connections of the
+// previous instance of the job instead of setting them up again
+func (j *Job) takeOver(logger log.Logger, queries map[string]string, previous *Job) error {
+	j.init(logger)
+	j.conns = previous.conns
+	jobConnections.WithLabelValues(j.Name).Set(float64(len(j.conns)))
+	j.dynamicConns = previous.dynamicConns
+	j.connectionsRefreshed = previous.connectionsRefreshed
+	// the default lifetime follows the interval, which may have changed
+	for _, conn := range j.conns {
+		if db := conn.conn.Load(); db != nil {
+			db.SetConnMaxLifetime(j.connMaxLifetime(conn.driver))
+			db.SetConnMaxIdleTime(j.ConnMaxIdleTime)
+		}
+	}
+	j.initQueries(queries)
+	return nil
+}
+
+// loadConnectionsFile appends the connections listed in the connections file,
+// one per line, to the connections of the job. It is safe to call it again.
+func (j *Job) loadConnectionsFile() error {
+	if j.ConnectionsFile == "" || j.connectionsFileLoaded {
+		return nil
+	}
+	buf, err := os.ReadFile(j.ConnectionsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read connections_file: %w", err)
+	}
+	configs, err := j.parseConnectionList(string(buf))
+	if err != nil {
+		return err
+	}
+	j.Connections = append(j.Connections, configs...)
+	j.connectionsFileLoaded = true
+	return nil
+}
+
+// sameConnections reports whether both jobs would set up the same connections
+func (j *Job) sameConnections(other *Job) bool {
+	return reflect.DeepEqual(j.Connections, other.Connections) &&
+		reflect.DeepEqual(j.StartupSQL, other.StartupSQL) &&
+		reflect.DeepEqual(j.TLS, other.TLS) &&
+		reflect.DeepEqual(j.ConnectionLabels, other.ConnectionLabels) &&
+		reflect.DeepEqual(j.ConnectionsCommand, other.ConnectionsCommand) &&
+		j.ConnectionsURL == other.ConnectionsURL &&
+		j.NormalizeHostLabel == other.NormalizeHostLabel &&
+		j.ConnMaxLifetime == other.ConnMaxLifetime &&
+		j.ConnMaxIdleTime == other.ConnMaxIdleTime &&
+		j.Timezone == other.Timezone &&
+		j.Charset == other.Charset &&
+		j.Collation == other.Collation
+}
+
+// connMaxLifetimeDefaults overrides the default conn_max_lifetime per driver.
+// Connections of the MSSQL driver are kept forever, closing them causes
+// issues with the driver we are using. See #60
+var connMaxLifetimeDefaults = map[string]time.Duration{
+	"sqlserver": -1,
+}
+
+// connMaxLifetime returns how long connections of the driver are used, twice
+// the interval unless configured otherwise. Zero or negative means forever.
+func (j *Job) connMaxLifetime(driver string) time.Duration {
+	if j.ConnMaxLifetime != 0 {
+		return j.ConnMaxLifetime
+	}
+	if d, found := connMaxLifetimeDefaults[driver]; found {
+		return d
+	}
+	return j.Interval * 2
+}
+
+func (j *Job) init(logger log.Logger) {
 	j.log = log.With(logger, "job", j.Name)
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	// a tiny interval turns ExecutePeriodically into a tight loop hammering the database
+	if j.CronSchedule.schedule == nil && j.Interval < minInterval {
+		level.Warn(j.log).Log("msg", "Interval is below the minimum, clamping", "interval", j.Interval, "min_interval", minInterval)
+		j.Interval = minInterval
+	}
+}
+
+// initQueries will initialize the metric descriptors
+func (j *Job) initQueries(queries map[string]string) {
+	j.queries = queries
+	// the queries of a reloaded job may have changed or been removed
+	queryInfo.DeletePartialMatch(prometheus.Labels{"sql_job": j.Name})
+	names := make(map[string]bool, len(j.Queries))
 	// register each query as an metric
 	for _, q := range j.Queries {
 		if q == nil {
@@ -69,339 +200,713 @@ func (j *Job) Init(logger log.Logger, queries map[string]string) error {
 		}
 		q.log = log.With(j.log, "query", q.Name)
 		q.jobName = j.Name
-		if q.Query == "" && q.QueryRef != "" {
-			if qry, found := queries[q.QueryRef]; found {
-				q.Query = qry
+		q.roleLabel = j.RoleLabel
+		q.connectionName = j.namedConnections()
+		q.connectionLabels = j.connectionLabelNames()
+		q.suffixRoles = j.suffixRoles()
+		if errs := q.Validate(queries); len(errs) > 0 {
+			for _, err := range errs {
+				level.Warn(q.log).Log("msg", "Invalid query", "err", err)
 			}
+			level.Warn(q.log).Log("msg", "Skipping invalid query")
+			q.invalid = true
+			q.skipReason = SkipInvalid
+			if _, found := queries[q.QueryRef]; q.Query == "" && q.QueryRef != "" && !found {
+				q.skipReason = SkipUnresolvedRef
+			}
+			continue
 		}
-		if q.Query == "" {
-			level.Warn(q.log).Log("msg", "Skipping empty query")
+		// the metrics of both would collide
+		if names[q.Name] {
+			level.Warn(q.log).Log("msg", "Skipping query. Another query of the job has the same name")
+			q.invalid = true
+			q.skipReason = SkipDuplicateName
 			continue
 		}
-		if q.metrics == nil {
-			// we have no way of knowing how many metrics will be returned by the
-			// queries, so we just assume that each query returns at least one metric.
-			// after the each round of collection this will be resized as necessary.
-			q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
-		}
-		// try to satisfy prometheus naming restrictions
-		name := MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
-		help := q.Help
-		// prepare a new metrics descriptor
-		//
-		// the tricky part here is that the *order* of labels has to match the
-		// order of label values supplied to NewConstMetric later
-		q.desc = prometheus.NewDesc(
-			name,
-			help,
-			append(q.Labels, "driver", "host", "database", "user", "col"),
-			prometheus.Labels{
-				"sql_job": j.Name,
-			},
-		)
+		names[q.Name] = true
+		if err := j.initQuery(q); err != nil {
+			// e.g. the query file may not exist yet, retry on the next run
+			level.Warn(q.log).Log("msg", "Failed to initialize query, retrying on the next run", "err", err)
+		}
 	}
-	j.updateConnections()
+	j.updateSkippedQueries()
+}
+
+// updateSkippedQueries exposes how many queries of the job are skipped and
+// why, queries which could not be initialized yet may still recover
+func (j *Job) updateSkippedQueries() {
+	skipped := make(map[string]int, len(skipReasons))
+	for _, q := range j.Queries {
+		if q == nil {
+			skipped[SkipEmpty]++
+			continue
+		}
+		q.Lock()
+		switch {
+		case q.skipReason != "":
+			skipped[q.skipReason]++
+		case q.desc == nil:
+			skipped[SkipNilDesc]++
+		}
+		q.Unlock()
+	}
+	for _, reason := range skipReasons {
+		jobSkippedQueries.WithLabelValues(j.Name, reason).Set(float64(skipped[reason]))
+	}
+}
+
+// suffixRoles returns the roles of the connections if they are appended to
+// the metric names
+func (j *Job) suffixRoles() []string {
+	if !j.RoleSuffix {
+		return nil
+	}
+	var roles []string
+	for _, cc := range j.Connections {
+		if cc.Role != "" && !slices.Contains(roles, cc.Role) {
+			roles = append(roles, cc.Role)
+		}
+	}
+	return roles
+}
+
+// namedConnections reports whether a connection of the job has a name, only
+// then the metrics of the job get the connection label
+func (j *Job) namedConnections() bool {
+	return slices.ContainsFunc(j.Connections, func(cc ConnectionConfig) bool { return cc.Name != "" })
+}
+
+// initQuery loads the query and prepares its metric descriptors
+func (j *Job) initQuery(q *Query) error {
+	if err := q.load(j.queries); err != nil {
+		return err
+	}
+	if q.Query == "" {
+		level.Warn(q.log).Log("msg", "Skipping empty query")
+		q.invalid = true
+		q.skipReason = SkipEmpty
+		return nil
+	}
+	if len(j.AllowedStatements) > 0 {
+		for _, query := range append([]string{q.Query}, q.FallbackQueries...) {
+			if err := checkStatements(query, j.AllowedStatements); err != nil {
+				level.Warn(q.log).Log("msg", "Skipping query. Statement not allowed", "err", err)
+				q.invalid = true
+				q.skipReason = SkipNotAllowed
+				return nil
+			}
+		}
+	}
+	queryInfo.WithLabelValues(j.Name, q.Name, querySHA(strings.Join(append([]string{q.Query}, q.FallbackQueries...), "\x00"))).Set(1)
+	if q.Type == TypeExec && len(q.Values) == 0 {
+		q.Values = []string{rowsAffectedColumn}
+	}
+	if q.metrics == nil {
+		// we have no way of knowing how many metrics will be returned by the
+		// queries, so we just assume that each query returns at least one metric.
+		// after the each round of collection this will be resized as necessary.
+		q.metrics = make(map[*connection][]prometheus.Metric, len(j.Queries))
+	}
+	name := q.metricName()
+	if lintUnits {
+		if err := q.lintUnit(); err != nil {
+			level.Warn(q.log).Log("msg", "Metric name lint", "err", err)
+		}
+	}
+	q.redactions = make(map[string]*regexp.Regexp, len(q.LabelRedactions))
+	for label, expr := range q.LabelRedactions {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			q.invalid = true
+			return fmt.Errorf("label_redactions: invalid regular expression for %q: %w", label, err)
+		}
+		q.redactions[label] = re
+	}
+	help := j.interpolateHelp(q)
+	q.initDescs(name, help)
 	return nil
 }
 
+// initDescs prepares the metric descriptors of the query with the help text
+func (q *Query) initDescs(name, help string) {
+	// prepare a new metrics descriptor
+	//
+	// the tricky part here is that the *order* of labels has to match the
+	// order of label values supplied to NewConstMetric later
+	connLabels := []string{"driver", "host", "database", "user"}
+	if q.connectionName {
+		connLabels = append(connLabels, connectionLabel)
+	}
+	if q.roleLabel != "" {
+		connLabels = append(connLabels, q.roleLabel)
+	}
+	connLabels = append(connLabels, q.connectionLabels...)
+	labels := append(append(q.labelNames(), connLabels...), "col")
+	constLabels := make(prometheus.Labels, len(externalLabels)+len(q.ConstLabels)+1)
+	for k, v := range externalLabels {
+		constLabels[k] = v
+	}
+	for k, v := range q.ConstLabels {
+		constLabels[k] = v
+	}
+	constLabels["sql_job"] = q.jobName
+	defaultType, _ := parseValueType(q.ValueType)
+	q.descs = make(map[string]*prometheus.Desc, len(q.Values)*(len(q.suffixRoles)+1))
+	q.valueTypes = make(map[string]prometheus.ValueType, len(q.Values))
+	// separate metrics don't need the col label, the column is in the name
+	separateLabels := append(q.labelNames(), connLabels...)
+	build := func(role, name string) *prometheus.Desc {
+		defaultDesc := prometheus.NewDesc(name, help, labels, constLabels)
+		// counters and gauges can't share a metric family, so every value type
+		// other than the default one gets its own family with the type as suffix
+		familyDescs := map[prometheus.ValueType]*prometheus.Desc{defaultType: defaultDesc}
+		for _, valueName := range q.Values {
+			valueType := defaultType
+			if t, found := q.ValueTypes[valueName]; found {
+				valueType, _ = parseValueType(t)
+			}
+			// a delta can go down, the family of the column must be a gauge
+			if q.isDelta(valueName) {
+				valueType = prometheus.GaugeValue
+			}
+			var desc *prometheus.Desc
+			if q.SeparateMetrics {
+				desc = prometheus.NewDesc(name+"_"+MetricNameRE.ReplaceAllString(valueName, ""), help, separateLabels, constLabels)
+			} else if desc = familyDescs[valueType]; desc == nil {
+				desc = prometheus.NewDesc(name+"_"+valueTypeName(valueType), help, labels, constLabels)
+				familyDescs[valueType] = desc
+			}
+			q.descs[descKey(role, valueName)] = desc
+			q.valueTypes[valueName] = valueType
+			if cfg, found := q.Smoothing[valueName]; found && cfg.KeepRaw {
+				rawDesc := desc
+				if q.SeparateMetrics {
+					rawDesc = prometheus.NewDesc(name+"_"+MetricNameRE.ReplaceAllString(valueName+rawSuffix, ""), help, separateLabels, constLabels)
+				}
+				q.descs[descKey(role, valueName+rawSuffix)] = rawDesc
+				q.valueTypes[valueName+rawSuffix] = valueType
+			}
+		}
+		return defaultDesc
+	}
+	defaultDesc := build("", name)
+	// connections of these roles get metrics of their own with the role
+	// appended to the name
+	for _, role := range q.suffixRoles {
+		q.descs[descKey(role, "")] = build(role, name+"_"+MetricNameRE.ReplaceAllString(role, ""))
+	}
+	// the descriptor is set last as it marks the query as initialized
+	q.desc = defaultDesc
+}
+
+// interpolateHelp replaces the connection placeholders in the help text.
+// All metrics of a family must share the help text, so it is only
+// interpolated if it comes out the same for every connection of the job.
+func (j *Job) interpolateHelp(q *Query) string {
+	if !strings.Contains(q.Help, "${") || len(j.conns) == 0 {
+		return q.Help
+	}
+	help := j.conns[0].interpolate(q.Help)
+	for _, conn := range j.conns[1:] {
+		if conn.interpolate(q.Help) != help {
+			level.Warn(q.log).Log("msg", "Help text differs between the connections of the job, not interpolating it", "help", q.Help)
+			return q.Help
+		}
+	}
+	return help
+}
+
+// interpolate replaces the placeholders of the connection details in s. They
+// are written as ${name}, unlike the environment placeholders, which are
+// replaced in the whole config before.
+func (c *connection) interpolate(s string) string {
+	placeholder := func(name string) string {
+		return "${" + name + "}"
+	}
+	return strings.NewReplacer(
+		placeholder("driver"), c.driver,
+		placeholder("host"), c.host,
+		placeholder("database"), c.database,
+		placeholder("user"), c.user,
+		placeholder("connection"), c.name,
+	).Replace(s)
+}
+
+// ensureInitialized retries the initialization of a query that could not be
+// initialized before and reports whether the query can be run
+func (j *Job) ensureInitialized(q *Query) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.desc != nil {
+		return true
+	}
+	if q.invalid {
+		return false
+	}
+	if err := j.initQuery(q); err != nil {
+		level.Warn(q.log).Log("msg", "Skipping query. Failed to initialize", "err", err)
+		return false
+	}
+	if q.desc != nil {
+		level.Info(q.log).Log("msg", "Query initialized")
+	}
+	return q.desc != nil
+}
+
 func (j *Job) updateConnections() {
-	// if there are no connection URLs for this job it can't be run
-	if j.Connections == nil {
-		level.Error(j.log).Log("msg", "no connections for job", "job_name", j.Name)
+	j.addConnections()
+	j.refreshConnections()
+	for _, conn := range j.conns {
+		if reason, insecure := conn.insecureTLS(j); insecure {
+			level.Warn(j.log).Log("msg", "Connection does not verify the TLS certificate of the server", "reason", reason, "driver", conn.driver, "host", conn.host)
+		}
 	}
+}
+
+// addConnections parses the connection URLs and creates the connections
+func (j *Job) addConnections() {
 	// make space for the connection objects
 	if j.conns == nil {
 		j.conns = make([]*connection, 0, len(j.Connections))
 	}
 	// parse the connection URLs and create a connection object for each
 	if len(j.conns) < len(j.Connections) {
-		for _, conn := range j.Connections {
-			// Check if we need to use cloudsql driver
-			if useCloudSQL, cloudsqlDriver := isValidCloudSQLDriver(conn); useCloudSQL {
-				// Do CloudSQL stuff
-				parsedU, err := ParseCloudSQLUrl(conn)
-				if err != nil {
-					level.Error(j.log).Log("msg", "could not parse cloudsql conn", "conn", conn)
-					continue
-				}
+		for _, cc := range j.Connections {
+			j.conns = append(j.conns, j.connectionsFor(cc)...)
+		}
+	}
+}
 
-				user := ""
-				if parsedU.User != nil {
-					user = parsedU.User.Username()
-				}
+// parseConnection parses a connection URL and returns the connection objects,
+// URLs with globs may yield several of them
+func (j *Job) parseConnection(cc ConnectionConfig) []*connection {
+	var conns []*connection
+	conn := cc.URL
+	// Check if we need to use cloudsql driver
+	if useCloudSQL, cloudsqlDriver := isValidCloudSQLDriver(conn); useCloudSQL {
+		// Do CloudSQL stuff
+		parsedU, err := ParseCloudSQLUrl(conn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "could not parse cloudsql conn", "conn", conn)
+			return conns
+		}
 
-				database := strings.TrimPrefix(parsedU.Path, "/")
+		user := ""
+		if parsedU.User != nil {
+			user = parsedU.User.Username()
+		}
 
-				if strings.ContainsRune(parsedU.Instance, '*') {
-					// We have a glob for the instance.
-					//	List all CloudSQL instance and figure out which ones match
-					ctx := context.Background()
-					instanceGlob := glob.MustCompile(parsedU.Instance)
-					databaseGlob := glob.MustCompile(database)
+		database := strings.TrimPrefix(parsedU.Path, "/")
 
-					// Create the Google Cloud SQL service.
-					service, err := sqladmin.NewService(ctx)
-					if err != nil {
-						level.Error(j.log).Log("msg", "could not create sqladmin client", "conn", conn, "err", err)
-						continue
-					}
+		if strings.ContainsRune(parsedU.Instance, '*') {
+			// We have a glob for the instance.
+			//	List all CloudSQL instance and figure out which ones match
+			ctx := context.Background()
+			instanceGlob := glob.MustCompile(parsedU.Instance)
+			databaseGlob := glob.MustCompile(database)
 
-					// List instances for the project ID.
-					instances, err := service.Instances.List(parsedU.Project).Do()
-					if err != nil {
-						level.Error(j.log).Log("msg", "could not list cloudsql instances", "conn", conn, "err", err)
-						continue
-					}
+			// Create the Google Cloud SQL service.
+			service, err := sqladmin.NewService(ctx)
+			if err != nil {
+				level.Error(j.log).Log("msg", "could not create sqladmin client", "conn", conn, "err", err)
+				return conns
+			}
 
-					for _, instance := range instances.Items {
+			// List instances for the project ID.
+			instances, err := service.Instances.List(parsedU.Project).Do()
+			if err != nil {
+				level.Error(j.log).Log("msg", "could not list cloudsql instances", "conn", conn, "err", err)
+				return conns
+			}
 
-						if !instanceGlob.Match(instance.Name) || parsedU.Region != instance.Region {
-							continue
-						}
+			for _, instance := range instances.Items {
 
-						if strings.ContainsRune(database, '*') {
-							// We have a glob for the database.
-							//	List all databases in instance and figure out which ones match
+				if !instanceGlob.Match(instance.Name) || parsedU.Region != instance.Region {
+					continue
+				}
 
-							// List databases for the instance.
-							databases, err := service.Databases.List(parsedU.Project, instance.Name).Do()
-							if err != nil {
-								level.Error(j.log).Log("msg", "could not list cloudsql databases", "instance", instance.Name, "err", err)
-								continue
-							}
+				if strings.ContainsRune(database, '*') {
+					// We have a glob for the database.
+					//	List all databases in instance and figure out which ones match
 
-							for _, db := range databases.Items {
-								if databaseGlob.Match(db.Name) {
-									connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, instance.ConnectionName, db.Name)
-									if err != nil {
-										level.Error(j.log).Log("msg", "could not generate connection url", "err", err)
-										continue
-									}
-									newConn := &connection{
-										conn:     nil,
-										url:      connectionURL,
-										driver:   cloudsqlDriver,
-										host:     instance.Name,
-										database: db.Name,
-										user:     user,
-									}
-									j.conns = append(j.conns, newConn)
-								}
-							}
-						} else {
-							connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, instance.ConnectionName, database)
+					// List databases for the instance.
+					databases, err := service.Databases.List(parsedU.Project, instance.Name).Do()
+					if err != nil {
+						level.Error(j.log).Log("msg", "could not list cloudsql databases", "instance", instance.Name, "err", err)
+						continue
+					}
+
+					for _, db := range databases.Items {
+						if databaseGlob.Match(db.Name) && !parsedU.IsExcluded(db.Name) {
+							connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, instance.ConnectionName, db.Name)
 							if err != nil {
 								level.Error(j.log).Log("msg", "could not generate connection url", "err", err)
 								continue
 							}
-
 							newConn := &connection{
-								conn:     nil,
+								name:     cc.Name,
 								url:      connectionURL,
 								driver:   cloudsqlDriver,
 								host:     instance.Name,
-								database: database,
+								database: db.Name,
 								user:     user,
 							}
-							j.conns = append(j.conns, newConn)
+							conns = append(conns, newConn)
 						}
 					}
-
 				} else {
-					connectionName := fmt.Sprintf("%s:%s:%s", parsedU.Project, parsedU.Region, parsedU.Instance)
-					connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, connectionName, database)
+					connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, instance.ConnectionName, database)
 					if err != nil {
 						level.Error(j.log).Log("msg", "could not generate connection url", "err", err)
 						continue
 					}
+
 					newConn := &connection{
-						conn:     nil,
+						name:     cc.Name,
 						url:      connectionURL,
 						driver:   cloudsqlDriver,
-						host:     parsedU.Host,
+						host:     instance.Name,
 						database: database,
 						user:     user,
 					}
-					j.conns = append(j.conns, newConn)
+					conns = append(conns, newConn)
 				}
-
-				continue
 			}
 
-			// Handle both RDS MySQL and regular MySQL connections
-			if strings.HasPrefix(conn, "rds-mysql://") || strings.HasPrefix(conn, "mysql://") {
-				isRDS := strings.HasPrefix(conn, "rds-mysql://")
-				var dsn string
-				var expirationTime time.Time
+		} else {
+			connectionName := fmt.Sprintf("%s:%s:%s", parsedU.Project, parsedU.Region, parsedU.Instance)
+			connectionURL, err := parsedU.GetConnectionURL(cloudsqlDriver, connectionName, database)
+			if err != nil {
+				level.Error(j.log).Log("msg", "could not generate connection url", "err", err)
+				return conns
+			}
+			newConn := &connection{
+				name:     cc.Name,
+				url:      connectionURL,
+				driver:   cloudsqlDriver,
+				host:     parsedU.Host,
+				database: database,
+				user:     user,
+			}
+			conns = append(conns, newConn)
+		}
 
-				trimmedConn := conn
-				if isRDS {
-					trimmedConn = strings.TrimPrefix(conn, "rds-mysql://")
-				} else {
-					trimmedConn = strings.TrimPrefix(conn, "mysql://")
-				}
+		return conns
+	}
 
-				config, err := mysql.ParseDSN(trimmedConn)
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to parse MySQL DSN", "url", conn, "err", err)
-					continue
-				}
+	// Handle both RDS MySQL and regular MySQL connections
+	if strings.HasPrefix(conn, "rds-mysql://") || strings.HasPrefix(conn, "mysql://") {
+		isRDS := strings.HasPrefix(conn, "rds-mysql://")
+		var dsn string
+		var expirationTime time.Time
 
-				if isRDS {
-					authToken, tokenExpiration, err := handleRDSMySQLIAMAuth(conn)
-					if err != nil {
-						level.Error(j.log).Log("msg", "Failed to build RDS auth token", "url", conn, "err", err)
-						continue
-					}
-					config.Passwd = authToken
-					config.AllowCleartextPasswords = true
-					expirationTime = tokenExpiration
-				}
+		trimmedConn := conn
+		if isRDS {
+			trimmedConn = strings.TrimPrefix(conn, "rds-mysql://")
+		} else {
+			trimmedConn = strings.TrimPrefix(conn, "mysql://")
+		}
 
-				dsn = config.FormatDSN()
-				if isRDS {
-					dsn = "rds-mysql://" + dsn
-				}
+		config, err := mysql.ParseDSN(trimmedConn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse MySQL DSN", "url", conn, "err", err)
+			return conns
+		}
 
-				j.conns = append(j.conns, &connection{
-					conn:                nil,
-					url:                 dsn,
-					driver:              "mysql",
-					host:                config.Addr,
-					database:            config.DBName,
-					user:                config.User,
-					tokenExpirationTime: expirationTime,
-				})
-				continue
+		if j.Timezone != "" {
+			loc, err := time.LoadLocation(j.Timezone)
+			if err != nil {
+				level.Error(j.log).Log("msg", "Invalid timezone", "timezone", j.Timezone, "err", err)
+				return conns
 			}
+			// without parseTime DATETIME columns are returned as text
+			config.ParseTime = true
+			config.Loc = loc
+		}
 
-			if strings.HasPrefix(conn, "rds-postgres://") {
-				// Reuse Postgres driver by stripping "rds-" from connection URL after building the RDS authentication token
-				conn = strings.TrimPrefix(conn, "rds-")
-				u, err := url.Parse(conn)
-				if err != nil {
-					level.Error(j.log).Log("msg", "failed to parse connection url", "url", conn, "err", err)
-					continue
-				}
-				sess := session.Must(session.NewSessionWithOptions(session.Options{
-					SharedConfigState: session.SharedConfigEnable,
-				}))
-				token, err := rdsutils.BuildAuthToken(u.Host, os.Getenv("AWS_REGION"), u.User.Username(), sess.Config.Credentials)
-				if err != nil {
-					level.Error(j.log).Log("msg", "failed to parse connection url", "url", conn, "err", err)
-					continue
-				}
-				conn = strings.Replace(conn, "AUTHTOKEN", url.QueryEscape(token), 1)
+		// without them the server default is used, which mangles labels
+		// with characters outside of it
+		if j.Charset != "" {
+			if config.Params == nil {
+				config.Params = make(map[string]string)
 			}
+			config.Params["charset"] = j.Charset
+		}
+		if j.Collation != "" {
+			config.Collation = j.Collation
+		}
 
-			if strings.HasPrefix(conn, "postgres://") || strings.HasPrefix(conn, "pg://") {
-				u, err := url.Parse(conn)
-				var filteredDBs []string
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
-					continue
-				}
-				if strings.Contains(u.Path, "include") || strings.Contains(u.Path, "exclude") {
-					if strings.Contains(u.Path, "include") && strings.Contains(u.Path, "exclude") {
-						level.Error(j.log).Log("msg", "You cannot use exclude and include:", "url", conn, "err", err)
-						return
-					} else {
-						extractedPath := u.Path //save pattern
-						u.Path = "/postgres"
-						dsn := u.String()
-						databases, err := listDatabases(dsn)
-						if err != nil {
-							level.Error(j.log).Log("msg", "Error listing databases", "url", conn, "err", err)
-							continue
-						}
-						filteredDBs, err = filterDatabases(databases, extractedPath)
-						if err != nil {
-							level.Error(j.log).Log("msg", "Error filtering databases", "url", conn, "err", err)
-							continue
-						}
-
-						for _, db := range filteredDBs {
-							u.Path = "/" + db // Set the path to the filtered database name
-							newUserDSN := u.String()
-							j.conns = append(j.conns, &connection{
-								conn:     nil,
-								url:      newUserDSN,
-								driver:   u.Scheme,
-								host:     u.Host,
-								database: db,
-								user:     u.User.Username(),
-							})
-						}
-						continue
-					}
-				}
+		if j.TLS != nil {
+			config.TLSConfig, err = j.TLS.registerMySQL(j.Name)
+			if err != nil {
+				level.Error(j.log).Log("msg", "Failed to set up TLS", "url", conn, "err", err)
+				return conns
 			}
+		}
 
-			u, err := url.Parse(conn)
+		var region string
+		if isRDS {
+			// unknown parameters are sent to the server as system variables
+			region = rdsRegion(config.Params["aws_region"], config.Addr)
+			delete(config.Params, "aws_region")
+			authToken, tokenExpiration, err := handleRDSMySQLIAMAuth(conn, region)
 			if err != nil {
-				level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
-				continue
+				level.Error(j.log).Log("msg", "Failed to build RDS auth token", "url", conn, "err", err)
+				return conns
 			}
-			user := ""
-			if u.User != nil {
-				user = u.User.Username()
+			config.Passwd = authToken
+			config.AllowCleartextPasswords = true
+			expirationTime = tokenExpiration
+		}
+
+		dsn = config.FormatDSN()
+		if isRDS {
+			dsn = "rds-mysql://" + dsn
+		}
+
+		conns = append(conns, &connection{
+			name:                cc.Name,
+			url:                 dsn,
+			driver:              "mysql",
+			host:                config.Addr,
+			database:            config.DBName,
+			user:                config.User,
+			awsRegion:           region,
+			tokenExpirationTime: expirationTime,
+		})
+		return conns
+	}
+
+	if strings.HasPrefix(conn, "rds-postgres://") {
+		// Reuse Postgres driver by stripping "rds-" from connection URL after building the RDS authentication token
+		conn = strings.TrimPrefix(conn, "rds-")
+		u, err := url.Parse(conn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "failed to parse connection url", "url", conn, "err", err)
+			return conns
+		}
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+		// lib/pq rejects unknown parameters
+		params := u.Query()
+		region := rdsRegion(params.Get("aws_region"), u.Host)
+		if params.Has("aws_region") {
+			params.Del("aws_region")
+			u.RawQuery = params.Encode()
+			conn = u.String()
+		}
+		token, err := rdsutils.BuildAuthToken(u.Host, region, u.User.Username(), sess.Config.Credentials)
+		if err != nil {
+			level.Error(j.log).Log("msg", "failed to parse connection url", "url", conn, "err", err)
+			return conns
+		}
+		conn = strings.Replace(conn, "AUTHTOKEN", url.QueryEscape(token), 1)
+	}
+
+	// lib/pq registers as "postgres" and only parses postgres:// URLs,
+	// so the pg:// alias has to be normalized before it is used as driver
+	if strings.HasPrefix(conn, "pg://") {
+		conn = "postgres://" + strings.TrimPrefix(conn, "pg://")
+	}
+
+	if j.Timezone != "" {
+		if strings.HasPrefix(conn, "postgres://") {
+			tzConn, err := withTimezone(conn, j.Timezone)
+			if err != nil {
+				level.Error(j.log).Log("msg", "Failed to set timezone", "url", conn, "err", err)
+				return conns
 			}
-			// we expose some of the connection variables as labels, so we need to
-			// remember them
-			newConn := &connection{
-				conn:     nil,
-				url:      conn,
-				driver:   u.Scheme,
-				host:     u.Host,
-				database: strings.TrimPrefix(u.Path, "/"),
-				user:     user,
+			conn = tzConn
+		} else {
+			level.Warn(j.log).Log("msg", "timezone is only supported for postgres and mysql, ignoring it", "url", conn)
+		}
+	}
+
+	if j.Charset != "" || j.Collation != "" {
+		level.Warn(j.log).Log("msg", "charset and collation are only supported for mysql, ignoring them", "url", conn)
+	}
+
+	if j.TLS != nil {
+		if strings.HasPrefix(conn, "postgres://") {
+			tlsConn, err := j.TLS.postgresURL(conn)
+			if err != nil {
+				level.Error(j.log).Log("msg", "Failed to set up TLS", "url", conn, "err", err)
+				return conns
 			}
-			if newConn.driver == "athena" {
-				// call go-athena's Open() to ensure conn.db is set,
-				// otherwise API calls will complain about an empty database field:
-				// "InvalidParameter: 1 validation error(s) found. - minimum field size of 1, StartQueryExecutionInput.QueryExecutionContext.Database."
-				newConn.conn, err = sqlx.Open("athena", u.String())
+			conn = tlsConn
+		} else {
+			level.Warn(j.log).Log("msg", "TLS settings are only supported for postgres and mysql, ignoring them", "url", conn)
+		}
+	}
+
+	if strings.HasPrefix(conn, "postgres://") {
+		u, err := url.Parse(conn)
+		var filteredDBs []string
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
+			return conns
+		}
+		if strings.Contains(u.Path, "include") || strings.Contains(u.Path, "exclude") {
+			if strings.Contains(u.Path, "include") && strings.Contains(u.Path, "exclude") {
+				level.Error(j.log).Log("msg", "You cannot use exclude and include:", "url", conn, "err", err)
+				return conns
+			} else {
+				extractedPath := u.Path //save pattern
+				u.Path = "/postgres"
+				dsn := u.String()
+				databases, err := listDatabases(dsn)
 				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to open Athena connection", "connection", conn, "err", err)
-					continue
+					level.Error(j.log).Log("msg", "Error listing databases", "url", conn, "err", err)
+					return conns
 				}
-			}
-			if newConn.driver == "snowflake" {
-				cfg := &gosnowflake.Config{
-					Account: u.Host,
-					User:    u.User.Username(),
+				filteredDBs, err = filterDatabases(databases, extractedPath)
+				if err != nil {
+					level.Error(j.log).Log("msg", "Error filtering databases", "url", conn, "err", err)
+					return conns
 				}
 
-				pw, set := u.User.Password()
-				if set {
-					cfg.Password = pw
+				for _, db := range filteredDBs {
+					u.Path = "/" + db // Set the path to the filtered database name
+					newUserDSN := u.String()
+					conns = append(conns, &connection{
+						name:     cc.Name,
+						url:      newUserDSN,
+						driver:   u.Scheme,
+						host:     u.Host,
+						database: db,
+						user:     u.User.Username(),
+					})
 				}
+				return conns
+			}
+		}
+	}
 
-				if u.Port() != "" {
-					portStr, err := strconv.Atoi(u.Port())
-					if err != nil {
-						level.Error(j.log).Log("msg", "Failed to parse Snowflake port", "connection", conn, "err", err)
-						continue
-					}
-					cfg.Port = portStr
-				}
+	if strings.HasPrefix(conn, "odbc://") {
+		if !odbcSupported {
+			level.Error(j.log).Log("msg", "ODBC connections require an exporter built with the odbc build tag", "connection", cc.Name)
+			return conns
+		}
+		dsn, host, database, user, err := parseODBC(conn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse ODBC connection string", "connection", cc.Name, "err", err)
+			return conns
+		}
+		conns = append(conns, &connection{
+			name:     cc.Name,
+			url:      dsn,
+			driver:   "odbc",
+			host:     host,
+			database: database,
+			user:     user,
+		})
+		return conns
+	}
 
-				dsn, err := gosnowflake.DSN(cfg)
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to create Snowflake DSN", "connection", conn, "err", err)
-					continue
-				}
+	if strings.HasPrefix(conn, "sqlserver://") {
+		u, host, err := parseMSSQLURL(conn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to parse MSSQL URL", "url", conn, "err", err)
+			return conns
+		}
+		user := ""
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		conns = append(conns, &connection{
+			name:     cc.Name,
+			url:      u.String(),
+			driver:   "sqlserver",
+			host:     host,
+			database: u.Query().Get("database"),
+			user:     user,
+		})
+		return conns
+	}
 
-				newConn.conn, err = sqlx.Open("snowflake", dsn)
-				if err != nil {
-					level.Error(j.log).Log("msg", "Failed to open Snowflake connection", "connection", conn, "err", err)
-					continue
-				}
+	u, err := url.Parse(conn)
+	if err != nil {
+		level.Error(j.log).Log("msg", "Failed to parse URL", "url", conn, "err", err)
+		return conns
+	}
+	user := ""
+	if u.User != nil {
+		user = u.User.Username()
+	}
+	// we expose some of the connection variables as labels, so we need to
+	// remember them
+	newConn := &connection{
+		name:     cc.Name,
+		url:      conn,
+		driver:   u.Scheme,
+		host:     u.Host,
+		database: strings.TrimPrefix(u.Path, "/"),
+		user:     user,
+	}
+	if newConn.driver == "athena" {
+		if err := cc.Athena.athenaURL(u); err != nil {
+			level.Error(j.log).Log("msg", "Invalid Athena connection", "connection", cc.Name, "err", err)
+			return conns
+		}
+		newConn.url = u.String()
+		// call go-athena's Open() to ensure conn.db is set,
+		// otherwise API calls will complain about an empty database field:
+		// "InvalidParameter: 1 validation error(s) found. - minimum field size of 1, StartQueryExecutionInput.QueryExecutionContext.Database."
+		db, err := sqlx.Open("athena", athenaDSN(newConn.url))
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to open Athena connection", "connection", conn, "err", err)
+			return conns
+		}
+		newConn.conn.Store(db)
+	}
+	if newConn.driver == "snowflake" {
+		cfg := &gosnowflake.Config{
+			Account: u.Host,
+			User:    u.User.Username(),
+		}
+
+		pw, set := u.User.Password()
+		if set {
+			cfg.Password = pw
+		}
+
+		key, err := snowflakePrivateKey(u.Query())
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to load Snowflake private key", "connection", cc.Name, "err", err)
+			return conns
+		}
+		if key != nil {
+			cfg.Authenticator = gosnowflake.AuthTypeJwt
+			cfg.PrivateKey = key
+		}
+
+		if u.Port() != "" {
+			portStr, err := strconv.Atoi(u.Port())
+			if err != nil {
+				level.Error(j.log).Log("msg", "Failed to parse Snowflake port", "connection", conn, "err", err)
+				return conns
 			}
+			cfg.Port = portStr
+		}
+
+		dsn, err := gosnowflake.DSN(cfg)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to create Snowflake DSN", "connection", conn, "err", err)
+			return conns
+		}
+		// the path is database/schema, only the database is used as label
+		newConn.database, _, _ = strings.Cut(newConn.database, "/")
 
-			j.conns = append(j.conns, newConn)
+		db, err := sqlx.Open("snowflake", dsn)
+		if err != nil {
+			level.Error(j.log).Log("msg", "Failed to open Snowflake connection", "connection", conn, "err", err)
+			return conns
 		}
+		newConn.conn.Store(db)
 	}
+
+	return append(conns, newConn)
 }
 
 func (j *Job) ExecutePeriodically() {
@@ -409,7 +914,49 @@ func (j *Job) ExecutePeriodically() {
 	for {
 		j.Run()
 		level.Debug(j.log).Log("msg", "Sleeping until next run", "sleep", j.Interval.String())
-		time.Sleep(j.Interval)
+		select {
+		case <-j.ctx.Done():
+			level.Debug(j.log).Log("msg", "Stopped")
+			return
+		case <-time.After(j.Interval):
+		}
+	}
+}
+
+// stop ends the execution of the job and waits for a running execution to finish
+func (j *Job) stop() {
+	j.cancel()
+	j.running.Lock()
+	defer j.running.Unlock()
+}
+
+// closeConnections closes all open database connections of the job
+func (j *Job) closeConnections() {
+	for _, conn := range j.conns {
+		conn.close(j)
+	}
+}
+
+// close executes the ShutdownSQL of the job and closes the connection.
+// Failing statements are logged only, the connection is closed anyway.
+func (c *connection) close(job *Job) {
+	db := c.conn.Load()
+	if db == nil {
+		return
+	}
+	for _, query := range job.ShutdownSQL {
+		level.Debug(job.log).Log("msg", "ShutdownSQL", "Query:", query)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownSQLTimeout)
+		_, err := db.ExecContext(ctx, query)
+		cancel()
+		if err != nil {
+			level.Warn(job.log).Log("msg", "Failed to execute ShutdownSQL", "err", err, "host", c.host, "query", query)
+		}
+	}
+	c.closeStatements()
+	c.conn.Store(nil)
+	if err := db.Close(); err != nil {
+		level.Warn(job.log).Log("msg", "Failed to close connection", "err", err, "host", c.host)
 	}
 }
 
@@ -420,21 +967,33 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 	}()
 
 	// connect to DB if not connected already
-	if err := conn.connect(j); err != nil {
-		level.Warn(j.log).Log("msg", "Failed to connect", "err", err, "host", conn.host)
+	err := conn.connect(j)
+	// updated even if refreshing the token failed, that's when it matters
+	if !conn.tokenExpirationTime.IsZero() {
+		connectionTokenExpiry.WithLabelValues(conn.driver, conn.host).Set(time.Until(conn.tokenExpirationTime).Seconds())
+	}
+	if err != nil {
+		errorClass := classifyError(err)
+		level.Warn(j.log).Log("msg", "Failed to connect", "err", err, "error_class", errorClass, "host", conn.host, "connection", conn.name)
+		conn.setLastError(errorClass)
 		j.markFailed(conn)
 		// we don't have the query name yet.
 		failedQueryCounter.WithLabelValues(j.Name, "").Inc()
 		return
 	}
+	conn.setLastError("")
 
+	batching := j.BatchQueries && batchDrivers[conn.driver]
+	var batch []*Query
 	for _, q := range j.Queries {
-		if q == nil {
+		if q == nil || q.Scope == ScopeAnyOne {
 			continue
 		}
-		if q.desc == nil {
-			// this may happen if the metric registration failed
-			level.Warn(q.log).Log("msg", "Skipping query. Collector is nil")
+		if !j.ensureInitialized(q) {
+			continue
+		}
+		if batching && q.batchable() {
+			batch = append(batch, q)
 			continue
 		}
 		level.Debug(q.log).Log("msg", "Running Query")
@@ -446,39 +1005,148 @@ func (j *Job) runOnceConnection(conn *connection, done chan int) {
 		level.Debug(q.log).Log("msg", "Query finished")
 		updated++
 	}
+	updated += j.runBatch(conn, batch)
+}
+
+// runAnyOne runs the queries with scope any_one on the connections in order
+// until it succeeds on one and returns the number of successful queries
+func (j *Job) runAnyOne() int {
+	updated := 0
+	for _, q := range j.Queries {
+		if q == nil || q.Scope != ScopeAnyOne {
+			continue
+		}
+		if !j.ensureInitialized(q) {
+			continue
+		}
+		var conn *connection
+		for _, c := range j.conns {
+			if c.conn.Load() == nil {
+				continue
+			}
+			// athena and snowflake pools are opened up front, so having a
+			// pool doesn't mean the database is reachable
+			if err := q.Run(c); err != nil {
+				level.Warn(q.log).Log("msg", "Failed to run query, trying the next connection", "err", err, "host", c.host)
+				continue
+			}
+			conn = c
+			break
+		}
+		if conn == nil {
+			level.Warn(q.log).Log("msg", "Query failed on all connections")
+			continue
+		}
+		// the series of a connection used before would duplicate the new ones
+		q.Lock()
+		for c := range q.metrics {
+			if c != conn {
+				q.evict(c)
+			}
+		}
+		q.Unlock()
+		updated++
+	}
+	return updated
 }
 
 func (j *Job) markFailed(conn *connection) {
 	for _, q := range j.Queries {
-		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+		setFailedScrape(conn, q.jobName, q.Name, 1.0)
 	}
 }
 
 // Run the job queries with exponential backoff, implements the cron.Job interface
 func (j *Job) Run() {
+	j.running.Lock()
+	defer j.running.Unlock()
+	// the job was stopped by a reload
+	if j.ctx.Err() != nil {
+		return
+	}
+	// covers the retries, too, so it shows runs exceeding the interval
+	jobScrapeInProgress.WithLabelValues(j.Name).Set(1)
+	defer jobScrapeInProgress.WithLabelValues(j.Name).Set(0)
+	start := time.Now()
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxElapsedTime = j.Interval
 	if bo.MaxElapsedTime == 0 {
 		bo.MaxElapsedTime = time.Minute
 	}
-	if err := backoff.Retry(j.runOnce, bo); err != nil {
+	err := backoff.Retry(j.runOnce, backoff.WithContext(bo, j.ctx))
+	if err != nil {
 		level.Error(j.log).Log("msg", "Failed to run", "err", err)
 	}
+	// runs interrupted by a reload didn't fail
+	if j.ctx.Err() == nil {
+		j.trackFailure(err)
+	}
+	j.statusLock.Lock()
+	j.lastRun = start
+	j.lastRunFinished = time.Now()
+	j.lastError = ""
+	if err != nil {
+		j.lastError = err.Error()
+	}
+	j.statusLock.Unlock()
+	if err := output.write(registry); err != nil {
+		level.Error(j.log).Log("msg", "Failed to write the output file", "err", err)
+	}
 }
 
 func (j *Job) runOnce() error {
-	doneChan := make(chan int, len(j.conns))
+	j.refreshConnections()
+	jobConnections.WithLabelValues(j.Name).Set(float64(len(j.conns)))
+	if len(j.conns) == 0 {
+		// retrying won't help until the connections are fetched again
+		level.Debug(j.log).Log("msg", "No connections, skipping run")
+		jobSuccess.WithLabelValues(j.Name).Set(0)
+		return nil
+	}
+	units := j.connectionUnits()
+	doneChan := make(chan int, len(units))
 
-	// execute queries for each connection in parallel
-	for _, conn := range j.conns {
-		go j.runOnceConnection(conn, doneChan)
+	// execute queries for each connection in parallel, at most
+	// max_parallel_connections at a time if set
+	var slots chan struct{}
+	if j.MaxParallelConnections > 0 {
+		slots = make(chan struct{}, j.MaxParallelConnections)
+	}
+	for _, unit := range units {
+		unit := unit
+		run := j.runOnceConnection
+		if unit[0].failoverGroup != "" {
+			run = func(_ *connection, done chan int) { j.runOnceGroup(unit, done) }
+		}
+		if slots == nil {
+			go run(unit[0], doneChan)
+			continue
+		}
+		slots <- struct{}{}
+		go func(conn *connection) {
+			defer func() { <-slots }()
+			run(conn, doneChan)
+		}(unit[0])
 	}
 
 	// connections now run in parallel, wait for and collect results
 	updated := 0
-	for range j.conns {
+	for range units {
 		updated += <-doneChan
 	}
+	updated += j.runAnyOne()
+	// queries which failed to initialize are retried by the run
+	j.updateSkippedQueries()
+
+	minSuccessful := j.MinSuccessfulQueries
+	if minSuccessful <= 0 {
+		minSuccessful = 1
+	}
+	if updated >= minSuccessful {
+		jobSuccess.WithLabelValues(j.Name).Set(1)
+	} else {
+		jobSuccess.WithLabelValues(j.Name).Set(0)
+	}
 
 	if updated < 1 {
 		return fmt.Errorf("zero queries ran")
@@ -486,13 +1154,108 @@ func (j *Job) runOnce() error {
 	return nil
 }
 
+// connectionUnits returns the connections which are run independently of
+// each other. Every failover group is a single unit with its connections in
+// the configured order.
+func (j *Job) connectionUnits() [][]*connection {
+	units := make([][]*connection, 0, len(j.conns))
+	groups := make(map[string]int)
+	for _, conn := range j.conns {
+		if conn.failoverGroup == "" {
+			units = append(units, []*connection{conn})
+			continue
+		}
+		if i, found := groups[conn.failoverGroup]; found {
+			units[i] = append(units[i], conn)
+			continue
+		}
+		groups[conn.failoverGroup] = len(units)
+		units = append(units, []*connection{conn})
+	}
+	return units
+}
+
+// runOnceGroup runs the queries on the first connection of the failover
+// group which is reachable and on which not all queries fail
+func (j *Job) runOnceGroup(conns []*connection, done chan int) {
+	perConnection := slices.ContainsFunc(j.Queries, func(q *Query) bool { return q != nil && q.Scope != ScopeAnyOne })
+	for _, conn := range conns {
+		err := conn.connect(j)
+		if err == nil {
+			// a pool connected before may have lost its database since
+			err = conn.ping(context.Background())
+		}
+		if err != nil {
+			errorClass := classifyError(err)
+			level.Warn(j.log).Log("msg", "Failed to connect, trying the next connection of the failover group", "err", err, "error_class", errorClass, "host", conn.host, "connection", conn.name, "failover_group", conn.failoverGroup)
+			conn.setLastError(errorClass)
+			j.markFailed(conn)
+			continue
+		}
+		j.activate(conn, conns)
+		result := make(chan int, 1)
+		j.runOnceConnection(conn, result)
+		updated := <-result
+		if updated > 0 || !perConnection {
+			done <- updated
+			return
+		}
+		level.Warn(j.log).Log("msg", "All queries failed, trying the next connection of the failover group", "host", conn.host, "connection", conn.name, "failover_group", conn.failoverGroup)
+	}
+	j.activate(nil, conns)
+	failedQueryCounter.WithLabelValues(j.Name, "").Inc()
+	done <- 0
+}
+
+// activate marks the connection as the active one of its failover group. The
+// metrics of the other connections are dropped, they would duplicate the
+// series of the active one. any_one queries may run on any member, their
+// metrics are kept.
+func (j *Job) activate(active *connection, group []*connection) {
+	for _, conn := range group {
+		value := 0.0
+		if conn == active {
+			value = 1
+		}
+		failoverActive.WithLabelValues(j.Name, conn.failoverGroup, conn.driver, conn.host, conn.database, conn.name).Set(value)
+		if conn == active {
+			continue
+		}
+		for _, q := range j.Queries {
+			if q == nil || q.Scope == ScopeAnyOne {
+				continue
+			}
+			q.Lock()
+			delete(q.metrics, conn)
+			q.Unlock()
+		}
+	}
+}
+
+// setLastError exposes the class of the last connection error, an empty
+// class clears it again
+func (c *connection) setLastError(errorClass string) {
+	connectionLastErrorInfo.DeletePartialMatch(prometheus.Labels{"driver": c.driver, "host": c.host})
+	if errorClass != "" {
+		connectionLastErrorInfo.WithLabelValues(c.driver, c.host, errorClass).Set(1)
+	}
+}
+
 func (c *connection) connect(job *Job) error {
+	c.connecting.Lock()
+	defer c.connecting.Unlock()
+	// lib/pq reads the client certificate only when connecting, so a rotated
+	// certificate needs a new connection
+	if c.certificatesRotated() && c.conn.Load() != nil {
+		level.Info(job.log).Log("msg", "Client certificate changed, reconnecting", "host", c.host)
+		c.close(job)
+	}
 	// already connected
-	if c.conn != nil {
+	if db := c.conn.Load(); db != nil {
 		if strings.HasPrefix(c.url, "rds-mysql://") && time.Now().After(c.tokenExpirationTime) {
 			level.Warn(job.log).Log("msg", "Connection token expired, reconnecting")
 
-			authToken, expirationTime, err := handleRDSMySQLIAMAuth(c.url)
+			authToken, expirationTime, err := handleRDSMySQLIAMAuth(c.url, c.awsRegion)
 			if err != nil {
 				return fmt.Errorf("failed to refresh RDS MySQL IAM Auth token: %w", err)
 			}
@@ -506,8 +1269,9 @@ func (c *connection) connect(job *Job) error {
 			dsn := "rds-mysql://" + config.FormatDSN()
 
 			// Close the existing connection
-			c.conn.Close()
-			c.conn = nil
+			c.closeStatements()
+			c.conn.Store(nil)
+			db.Close()
 
 			// Update the connection details
 			c.tokenExpirationTime = expirationTime
@@ -518,7 +1282,7 @@ func (c *connection) connect(job *Job) error {
 			if err != nil {
 				return fmt.Errorf("failed to connect to the database: %w", err)
 			}
-			c.conn = conn
+			c.conn.Store(conn)
 			return nil
 		}
 		return nil
@@ -533,6 +1297,8 @@ func (c *connection) connect(job *Job) error {
 		c.driver = "clickhouse"
 	case "clickhouse": // Backward compatible alias
 		dsn = "tcp://" + strings.TrimPrefix(dsn, "clickhouse://")
+	case "athena":
+		dsn = athenaDSN(dsn)
 	}
 	conn, err := sqlx.Connect(c.driver, dsn)
 	if err != nil {
@@ -541,17 +1307,27 @@ func (c *connection) connect(job *Job) error {
 	// be nice and don't use up too many connections for mere metrics
 	conn.SetMaxOpenConns(1)
 	conn.SetMaxIdleConns(1)
-	// Disable SetConnMaxLifetime if MSSQL as it is causing issues with the MSSQL driver we are using. See #60
-	if c.driver != "sqlserver" {
-		conn.SetConnMaxLifetime(job.Interval * 2)
-	}
+	conn.SetConnMaxLifetime(job.connMaxLifetime(c.driver))
+	conn.SetConnMaxIdleTime(job.ConnMaxIdleTime)
 
 	// execute StartupSQL
 	for _, query := range job.StartupSQL {
 		level.Debug(job.log).Log("msg", "StartupSQL", "Query:", query)
-		conn.MustExec(query)
+		if _, err := conn.ExecContext(context.Background(), query); err != nil {
+			conn.Close()
+			return fmt.Errorf("startup_sql %q failed: %w", query, err)
+		}
+	}
+
+	if job.ConnectionLabels != nil {
+		labels, err := queryConnectionLabels(conn, job.ConnectionLabels)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("connection_labels: %w", err)
+		}
+		c.labels = labels
 	}
 
-	c.conn = conn
+	c.conn.Store(conn)
 	return nil
 }
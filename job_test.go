@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+func TestPgConnectionUsesPostgresDriver(t *testing.T) {
+	j := &Job{Name: "test", log: log.NewNopLogger()}
+	conns := j.connectionsFor(ConnectionConfig{URL: "pg://user:secret@db.example.com:5432/app?sslmode=disable"})
+	if len(conns) != 1 {
+		t.Fatalf("got %d connections, want 1", len(conns))
+	}
+	conn := conns[0]
+	if conn.driver != "postgres" {
+		t.Errorf("driver = %q, want postgres", conn.driver)
+	}
+	if !strings.HasPrefix(conn.url, "postgres://") {
+		t.Errorf("url = %q, want the postgres:// scheme", conn.url)
+	}
+	if conn.host != "db.example.com:5432" || conn.database != "app" || conn.user != "user" {
+		t.Errorf("labels = %q, %q, %q, want db.example.com:5432, app, user", conn.host, conn.database, conn.user)
+	}
+	// lib/pq has to accept the URL and the driver name, opening doesn't
+	// connect yet
+	if _, err := pq.ParseURL(conn.url); err != nil {
+		t.Errorf("lib/pq rejects the url: %v", err)
+	}
+	db, err := sqlx.Open(conn.driver, conn.url)
+	if err != nil {
+		t.Fatalf("opening the connection: %v", err)
+	}
+	db.Close()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is either a key of an object or an index of an array
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+// parseJSONPath parses the simple JSONPath subset of json_paths, e.g.
+// $.stats.rows or $.replicas[0].lag, the leading $ is optional
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var steps []jsonPathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in JSON path %q", path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[:end], index: -1})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSON path %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q in JSON path %q", rest[1:end], path)
+			}
+			steps = append(steps, jsonPathStep{index: index})
+			rest = rest[end+1:]
+		default:
+			if len(steps) > 0 {
+				return nil, fmt.Errorf("unexpected %q in JSON path %q", rest[0], path)
+			}
+			// a path without $ may start with the key right away
+			rest = "." + rest
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSON returns the value at the path and whether it exists
+func lookupJSON(doc interface{}, steps []jsonPathStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.index < 0 {
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = object[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		array, ok := doc.([]interface{})
+		if !ok || step.index >= len(array) {
+			return nil, false
+		}
+		doc = array[step.index]
+	}
+	return doc, doc != nil
+}
+
+// expandJSON adds the fields selected by json_paths to a copy of every row,
+// so they can be used as values and labels like any other column. Missing
+// fields are left out, they are handled like missing columns.
+func (q *Query) expandJSON(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	paths := make(map[string][]jsonPathStep, len(q.JSONPaths))
+	for column, path := range q.JSONPaths {
+		steps, err := parseJSONPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("json_paths: %w", err)
+		}
+		paths[column] = steps
+	}
+	expanded := make([]map[string]interface{}, 0, len(rows))
+	for _, res := range rows {
+		// the rows may be shared with the result cache
+		row := make(map[string]interface{}, len(res)+len(paths))
+		for column, value := range res {
+			row[column] = value
+		}
+		expanded = append(expanded, row)
+		var raw []byte
+		switch doc := res[q.JSONColumn].(type) {
+		case string:
+			raw = []byte(doc)
+		case []uint8:
+			raw = doc
+		case nil:
+			continue
+		default:
+			return nil, fmt.Errorf("column '%s' must be a JSON document, is '%T'", q.JSONColumn, doc)
+		}
+		var doc interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("column '%s' is not valid JSON: %w", q.JSONColumn, err)
+		}
+		for column, steps := range paths {
+			value, found := lookupJSON(doc, steps)
+			if !found {
+				continue
+			}
+			row[column] = q.coerceJSON(column, value)
+		}
+	}
+	return expanded, nil
+}
+
+// coerceJSON converts a JSON field to the type expected of a label or a value
+// column, other types are passed on to fail there with the usual error
+func (q *Query) coerceJSON(column string, value interface{}) interface{} {
+	if slices.ContainsFunc(q.Labels, func(l LabelConfig) bool { return l.Column == column }) {
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			return strconv.FormatBool(v)
+		}
+		return value
+	}
+	if v, ok := value.(bool); ok {
+		if v {
+			return 1.0
+		}
+		return 0.0
+	}
+	return value
+}
@@ -5,19 +5,22 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-  "github.com/prometheus/common/version"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	prom_collectors_version "github.com/prometheus/client_golang/prometheus/collectors/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
 	_ "go.uber.org/automaxprocs"
 )
 
 func init() {
-	prometheus.MustRegister(prom_collectors_version.NewCollector("sql_exporter"))
+	registry.MustRegister(prom_collectors_version.NewCollector("sql_exporter"))
 }
 
 func main() {
@@ -26,6 +29,16 @@ func main() {
 		listenAddress = flag.String("web.listen-address", ":9237", "Address to listen on for web interface and telemetry.")
 		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
 		configFile    = flag.String("config.file", os.Getenv("CONFIG"), "SQL Exporter configuration file name.")
+		configRefresh = flag.Duration("config.refresh-interval", time.Minute, "How often a configuration given as URL is fetched again and reloaded if it changed.")
+		configCheck   = flag.Bool("config.check", false, "Validate the configuration file and exit.")
+		testConns     = flag.Bool("config.test-connections", false, "Connect to every configured database, report the result and exit.")
+		lifecycle     = flag.Bool("web.enable-lifecycle", false, "Enable reloading the configuration via HTTP request.")
+		openMetrics   = flag.Bool("web.enable-openmetrics", false, "Enable the OpenMetrics exposition format if requested by the scraper.")
+		healthzProbe  = flag.Bool("db.connectivity-as-healthz", false, "Ping all database connections on /healthz and fail it if any is down.")
+		routePrefix   = flag.String("web.route-prefix", "/", "Prefix for all HTTP routes, e.g. when running behind a reverse proxy.")
+		noDefaults    = flag.Bool("web.disable-default-collectors", false, "Don't expose the Go runtime and process metrics, only those of the exporter.")
+		jobFilterExpr = flag.String("job.filter", "", "Only run the jobs whose name matches this regular expression.")
+		shard         = flag.String("exporter.shard", os.Getenv("SHARD"), "Identity of this exporter, jobs with run_on only run on the listed shards.")
 	)
 
 	flag.Parse()
@@ -35,6 +48,21 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *configCheck {
+		errs, warnings := CheckConfig(*configFile)
+		for _, warning := range warnings {
+			fmt.Fprintln(os.Stderr, "warning:", warning)
+		}
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, "Configuration is valid")
+		os.Exit(0)
+	}
+
 	// init logger
 	logger := log.NewJSONLogger(os.Stdout)
 	// set the allowed log level filter
@@ -55,24 +83,118 @@ func main() {
 		"caller", log.DefaultCaller,
 	)
 
+	if err := setJobFilter(*jobFilterExpr); err != nil {
+		level.Error(logger).Log("msg", "Error starting exporter", "err", err)
+		os.Exit(1)
+	}
+	exporterShard = *shard
+
+	if *testConns {
+		errs := TestConnections(logger, *configFile, os.Stdout)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logger.Log("msg", "Starting sql_exporter", "version_info", version.Info(), "build_context", version.BuildContext())
 
+	if !*noDefaults {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
 	exporter, err := NewExporter(logger, *configFile)
 	if err != nil {
 		level.Error(logger).Log("msg", "Error starting exporter", "err", err)
 		os.Exit(1)
 	}
-	prometheus.MustRegister(exporter)
+	registry.MustRegister(exporter)
+
+	if isRemoteConfig(*configFile) && *configRefresh > 0 {
+		go watchRemoteConfig(logger, *configFile, *configRefresh, exporter.Reload)
+	}
+
+	// reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := exporter.Reload(); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded config")
+		}
+	}()
+
+	// close the connections gracefully on SIGTERM and SIGINT
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-term
+		level.Info(logger).Log("msg", "Shutting down")
+		exporter.Shutdown()
+		os.Exit(0)
+	}()
 
 	// setup and start webserver
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(*routePrefix, "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	route := func(path string) string {
+		return prefix + path
+	}
+	http.Handle(route(*metricsPath), promhttp.InstrumentMetricHandler(
+		registry,
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			EnableOpenMetrics: *openMetrics,
+		}),
+	))
+	http.HandleFunc(route("/healthz"), func(w http.ResponseWriter, r *http.Request) {
+		if *healthzProbe {
+			if err := exporter.Probe(r.Context()); err != nil {
+				http.Error(w, fmt.Sprintf("connectivity probe failed: %s", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		http.Error(w, "OK", http.StatusOK)
+	})
+	http.HandleFunc(route("/-/ready"), func(w http.ResponseWriter, r *http.Request) {
+		if !exporter.Ready() {
+			http.Error(w, "Warming up", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "OK", http.StatusOK)
+	})
+	http.HandleFunc(route("/status"), exporter.ServeStatus)
+	if *lifecycle {
+		http.HandleFunc(route("/-/reload"), func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost && r.Method != http.MethodPut {
+				http.Error(w, "This endpoint requires a POST or PUT request.", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := exporter.Reload(); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+				http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+				return
+			}
+			level.Info(logger).Log("msg", "Reloaded config")
+		})
+	}
+	http.HandleFunc(route("/"), func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 		<head><title>SQL Exporter</title></head>
 		<body>
 		<h1>SQL Exporter</h1>
-		<p><a href="` + *metricsPath + `">Metrics</a></p>
+		<p><a href="` + route(*metricsPath) + `">Metrics</a></p>
+		<p><a href="` + route("/status") + `">Status</a></p>
 		</body>
 		</html>
 		`))
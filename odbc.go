@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// odbcSupported is set when the exporter is built with the odbc build tag,
+// the ODBC driver requires cgo and the unixODBC headers
+var odbcSupported bool
+
+// parseODBC splits an odbc://DSN=name;UID=user;Database=db connection string
+// into the connection string passed to the driver and the labels. The data
+// source name is used as host label.
+func parseODBC(conn string) (dsn, host, database, user string, err error) {
+	dsn = strings.TrimPrefix(conn, "odbc://")
+	for _, attr := range strings.Split(dsn, ";") {
+		key, value, _ := strings.Cut(attr, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "dsn":
+			host = strings.TrimSpace(value)
+		case "database":
+			database = strings.TrimSpace(value)
+		case "uid":
+			user = strings.TrimSpace(value)
+		}
+	}
+	if host == "" {
+		return "", "", "", "", fmt.Errorf("missing DSN attribute")
+	}
+	return dsn, host, database, user, nil
+}
@@ -0,0 +1,11 @@
+//go:build odbc
+
+package main
+
+import (
+	_ "github.com/alexbrainman/odbc" // register the ODBC driver
+)
+
+func init() {
+	odbcSupported = true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// output formats of the output file
+const (
+	OutputFormatText = "text"
+	OutputFormatJSON = "json"
+)
+
+// OutputFileConfig configures writing all metrics to a file after every run
+// of a job, for environments without a scraper
+type OutputFileConfig struct {
+	Path       string `yaml:"path"`
+	Format     string `yaml:"format"`      // text (default) or json with one sample per line
+	MaxSizeMB  int    `yaml:"max_size_mb"` // rotate the file once it is larger, 0 disables rotation
+	MaxBackups int    `yaml:"max_backups"` // rotated files to keep, defaults to 1
+}
+
+// Validate checks the output file configuration
+func (c *OutputFileConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("output_file: path must be set")
+	}
+	if c.Format != "" && c.Format != OutputFormatText && c.Format != OutputFormatJSON {
+		return fmt.Errorf("output_file: format must be %s or %s", OutputFormatText, OutputFormatJSON)
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("output_file: max_size_mb and max_backups must not be negative")
+	}
+	return nil
+}
+
+// outputWriter appends the gathered metrics to the output file
+type outputWriter struct {
+	sync.Mutex
+	cfg *OutputFileConfig
+}
+
+// output is set if the metrics are written to a file
+var output = &outputWriter{}
+
+// configure replaces the configuration, nil disables the output file
+func (w *outputWriter) configure(cfg *OutputFileConfig) {
+	w.Lock()
+	defer w.Unlock()
+	w.cfg = cfg
+}
+
+// write appends the current state of all metrics to the output file
+func (w *outputWriter) write(gatherer prometheus.Gatherer) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.cfg == nil {
+		return nil
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(w.cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(fh)
+	now := time.Now().UnixMilli()
+	if w.cfg.Format == OutputFormatJSON {
+		err = writeJSONLines(buf, families, now)
+	} else {
+		err = writeText(buf, families, now)
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate renames the output file to path.1, path.1 to path.2 and so on once
+// it is larger than max_size_mb
+func (w *outputWriter) rotate() error {
+	if w.cfg.MaxSizeMB <= 0 {
+		return nil
+	}
+	info, err := os.Stat(w.cfg.Path)
+	if err != nil || info.Size() < int64(w.cfg.MaxSizeMB)<<20 {
+		return nil
+	}
+	backups := w.cfg.MaxBackups
+	if backups == 0 {
+		backups = 1
+	}
+	for i := backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.cfg.Path, i), fmt.Sprintf("%s.%d", w.cfg.Path, i+1))
+	}
+	return os.Rename(w.cfg.Path, w.cfg.Path+".1")
+}
+
+// writeText writes the metrics in the text exposition format. Every sample
+// carries the timestamp, so the appended snapshots can be told apart. The
+// gathered metrics are not shared, so they are modified in place.
+func writeText(buf *bufio.Writer, families []*dto.MetricFamily, now int64) error {
+	for _, family := range families {
+		for _, m := range family.Metric {
+			if m.TimestampMs == nil {
+				m.TimestampMs = &now
+			}
+		}
+		if _, err := expfmt.MetricFamilyToText(buf, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonSample is a line of the json output format
+type jsonSample struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Value       float64           `json:"value"`
+	TimestampMs int64             `json:"timestamp_ms"`
+}
+
+// MarshalJSON writes special float values as strings, JSON has no NaN
+func (s jsonSample) MarshalJSON() ([]byte, error) {
+	type plain jsonSample
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return json.Marshal(struct {
+			plain
+			Value string `json:"value"`
+		}{plain(s), fmt.Sprint(s.Value)})
+	}
+	return json.Marshal(plain(s))
+}
+
+// writeJSONLines writes one JSON object per sample. Histograms and summaries
+// are split up into their series like in the text format.
+func writeJSONLines(buf *bufio.Writer, families []*dto.MetricFamily, now int64) error {
+	enc := json.NewEncoder(buf)
+	for _, family := range families {
+		for _, m := range family.Metric {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			sample := func(suffix string, value float64, extra ...string) error {
+				sampleLabels := labels
+				if len(extra) == 2 {
+					sampleLabels = make(map[string]string, len(labels)+1)
+					for k, v := range labels {
+						sampleLabels[k] = v
+					}
+					sampleLabels[extra[0]] = extra[1]
+				}
+				return enc.Encode(jsonSample{Name: family.GetName() + suffix, Labels: sampleLabels, Value: value, TimestampMs: ts})
+			}
+			var err error
+			switch {
+			case m.Counter != nil:
+				err = sample("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				err = sample("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				err = sample("", m.Untyped.GetValue())
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					if err = sample("", q.GetValue(), "quantile", fmt.Sprint(q.GetQuantile())); err != nil {
+						return err
+					}
+				}
+				if err = sample("_sum", m.Summary.GetSampleSum()); err == nil {
+					err = sample("_count", float64(m.Summary.GetSampleCount()))
+				}
+			case m.Histogram != nil:
+				for _, b := range m.Histogram.Bucket {
+					if err = sample("_bucket", float64(b.GetCumulativeCount()), "le", fmt.Sprint(b.GetUpperBound())); err != nil {
+						return err
+					}
+				}
+				if err = sample("_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf"); err == nil {
+					if err = sample("_sum", m.Histogram.GetSampleSum()); err == nil {
+						err = sample("_count", float64(m.Histogram.GetSampleCount()))
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
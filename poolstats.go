@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolStatsLabels identify the connection pool of a connection
+var poolStatsLabels = []string{"driver", "host", "database", "user", "connection", "sql_job"}
+
+var (
+	poolOpenDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_db_connections_open", metricsPrefix),
+		"Number of established connections of the pool, in use or idle.",
+		poolStatsLabels, nil,
+	)
+	poolInUseDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_db_connections_in_use", metricsPrefix),
+		"Number of connections of the pool currently in use.",
+		poolStatsLabels, nil,
+	)
+	poolIdleDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_db_connections_idle", metricsPrefix),
+		"Number of idle connections of the pool.",
+		poolStatsLabels, nil,
+	)
+	poolWaitCountDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_db_connections_wait_count", metricsPrefix),
+		"Total number of times a query had to wait for a connection of the pool.",
+		poolStatsLabels, nil,
+	)
+	poolWaitDurationDesc = prometheus.NewDesc(
+		fmt.Sprintf("%s_db_connections_wait_duration_seconds_total", metricsPrefix),
+		"Total time spent waiting for a connection of the pool.",
+		poolStatsLabels, nil,
+	)
+)
+
+// describePoolStats sends the descriptors of the pool statistics
+func describePoolStats(ch chan<- *prometheus.Desc) {
+	ch <- poolOpenDesc
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolWaitCountDesc
+	ch <- poolWaitDurationDesc
+}
+
+// collectPoolStats sends the statistics of the connection pool of every
+// established connection of the job
+func collectPoolStats(ch chan<- prometheus.Metric, job *Job) {
+	job.connsLock.RLock()
+	defer job.connsLock.RUnlock()
+	for _, conn := range job.conns {
+		db := conn.conn.Load()
+		if db == nil {
+			continue
+		}
+		stats := db.Stats()
+		labels := []string{conn.driver, conn.host, conn.database, conn.user, conn.name, job.Name}
+		ch <- prometheus.MustNewConstMetric(poolOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), labels...)
+		ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.InUse), labels...)
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.Idle), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), labels...)
+		ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), labels...)
+	}
+}
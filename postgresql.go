@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
 
@@ -78,3 +79,15 @@ func parsePattern(pattern string) (mode string, dbs string) {
 	}
 	return "", ""
 }
+
+// withTimezone sets the TimeZone of the sessions of a postgres connection URL
+func withTimezone(conn, timezone string) (string, error) {
+	u, err := url.Parse(conn)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	params.Set("timezone", timezone)
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
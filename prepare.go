@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/go-kit/log/level"
+	"github.com/jmoiron/sqlx"
+)
+
+// preparedQueryer runs a prepared statement, the query text passed to it is
+// ignored as it was given when preparing
+type preparedQueryer struct {
+	stmt *sqlx.Stmt
+}
+
+func (p preparedQueryer) QueryContext(ctx context.Context, _ string, args ...interface{}) (*sql.Rows, error) {
+	return p.stmt.QueryContext(ctx, args...)
+}
+
+func (p preparedQueryer) QueryxContext(ctx context.Context, _ string, args ...interface{}) (*sqlx.Rows, error) {
+	return p.stmt.QueryxContext(ctx, args...)
+}
+
+func (p preparedQueryer) QueryRowxContext(ctx context.Context, _ string, args ...interface{}) *sqlx.Row {
+	return p.stmt.QueryRowxContext(ctx, args...)
+}
+
+// prepared returns the statement of the query prepared on the connection
+// pool, preparing it on first use. Sessions, drivers which can't prepare and
+// queries without prepare use db directly.
+func (q *Query) prepared(ctx context.Context, db sqlx.QueryerContext, conn *connection, query string) sqlx.QueryerContext {
+	if pool, ok := db.(*sqlx.DB); !q.Prepare || !ok || pool != conn.conn.Load() {
+		return db
+	}
+	conn.stmtsLock.Lock()
+	defer conn.stmtsLock.Unlock()
+	stmt, found := conn.stmts[query]
+	if !found {
+		var err error
+		stmt, err = conn.conn.Load().PreparexContext(ctx, query)
+		if err != nil {
+			// e.g. Athena doesn't support prepared statements, don't try again
+			level.Warn(q.log).Log("msg", "Failed to prepare query, running it unprepared", "err", err, "driver", conn.driver)
+			stmt = nil
+		}
+		if conn.stmts == nil {
+			conn.stmts = make(map[string]*sqlx.Stmt)
+		}
+		conn.stmts[query] = stmt
+	}
+	if stmt == nil {
+		return db
+	}
+	return preparedQueryer{stmt: stmt}
+}
+
+// closeStatements closes the prepared statements, they are bound to the
+// connection pool and have to be prepared again after reconnecting
+func (c *connection) closeStatements() {
+	c.stmtsLock.Lock()
+	defer c.stmtsLock.Unlock()
+	for _, stmt := range c.stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	c.stmts = nil
+}
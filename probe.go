@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds the ping of a single connection
+const probeTimeout = 5 * time.Second
+
+// Probe pings the connections of all jobs in parallel and exposes the result
+// per connection. Connections which are not established are failures.
+func (e *Exporter) Probe(ctx context.Context) error {
+	e.RLock()
+	jobs := e.jobs
+	e.RUnlock()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	connectionProbeSuccess.Reset()
+	connectionProbeDuration.Reset()
+	for _, job := range jobs {
+		job.connsLock.RLock()
+		conns := job.conns
+		job.connsLock.RUnlock()
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *connection) {
+				defer wg.Done()
+				err := conn.probe(ctx)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s/%s: %w", conn.host, conn.database, err))
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// probe pings the database and records the result
+func (c *connection) probe(ctx context.Context) error {
+	start := time.Now()
+	err := c.ping(ctx)
+	success := 0.0
+	if err == nil {
+		success = 1
+	}
+	connectionProbeSuccess.WithLabelValues(c.driver, c.host, c.database).Set(success)
+	connectionProbeDuration.WithLabelValues(c.driver, c.host, c.database).Set(time.Since(start).Seconds())
+	return err
+}
+
+// ping checks within probeTimeout that the database of the connection is
+// reachable
+func (c *connection) ping(ctx context.Context) error {
+	db := c.conn.Load()
+	if db == nil {
+		return fmt.Errorf("not connected")
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
@@ -1,22 +1,181 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// redactedPlaceholder replaces the parts of label values matched by
+// label_redactions
+const redactedPlaceholder = "REDACTED"
+
+// knownValueTypes maps the configurable value types to the prometheus ones
+var knownValueTypes = map[string]prometheus.ValueType{
+	"gauge":   prometheus.GaugeValue,
+	"counter": prometheus.CounterValue,
+	"untyped": prometheus.UntypedValue,
+}
+
+// parseValueType returns the prometheus value type, defaulting to gauge
+func parseValueType(valueType string) (prometheus.ValueType, error) {
+	if valueType == "" {
+		return prometheus.GaugeValue, nil
+	}
+	if t, found := knownValueTypes[strings.ToLower(valueType)]; found {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown value type %q", valueType)
+}
+
+// valueTypeName is the inverse of parseValueType
+func valueTypeName(valueType prometheus.ValueType) string {
+	for name, t := range knownValueTypes {
+		if t == valueType {
+			return name
+		}
+	}
+	return ""
+}
+
+// valueDesc returns the descriptor and the value type of a value column
+func (q *Query) valueDesc(role, valueName string) (*prometheus.Desc, prometheus.ValueType) {
+	// the descriptors are prepared again once the help is established
+	q.Lock()
+	defer q.Unlock()
+	// connections of roles unknown at initialization get the plain names
+	roleDesc, found := q.descs[descKey(role, "")]
+	if !found {
+		role, roleDesc = "", q.desc
+	}
+	if desc, found := q.descs[descKey(role, valueName)]; found {
+		return desc, q.valueTypes[valueName]
+	}
+	// e.g. the column of a scalar query, which has the default type
+	valueType, _ := parseValueType(q.ValueType)
+	return roleDesc, valueType
+}
+
+// descKey identifies the descriptor of a value column in descs. Connections
+// whose role is appended to the metric name have descriptors of their own.
+func descKey(role, valueName string) string {
+	if role == "" {
+		return valueName
+	}
+	return role + "\x00" + valueName
+}
+
+// metricName returns the metric name of the query, with the unit appended
+// unless the name already ends with it
+func (q *Query) metricName() string {
+	// try to satisfy prometheus naming restrictions
+	name := MetricNameRE.ReplaceAllString("sql_"+q.Name, "")
+	if q.Unit != "" && !strings.HasSuffix(name, "_"+q.Unit) {
+		name += "_" + q.Unit
+	}
+	return name
+}
+
+// labelNames returns the names of the labels taken from columns
+func (q *Query) labelNames() []string {
+	names := make([]string, 0, len(q.Labels))
+	for _, label := range q.Labels {
+		names = append(names, label.Label)
+	}
+	return names
+}
+
+// querySHA returns a short hash of the query text, it changes whenever the
+// query is edited
+func querySHA(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:6])
+}
+
+// load resolves the query text from whichever source is configured. Queries
+// read from a file or decoded from base64 are not part of the config file,
+// so the environment placeholders are replaced here.
+func (q *Query) load(queries map[string]string) error {
+	var raw []byte
+	switch {
+	case q.Query != "":
+		return nil
+	case q.QueryRef != "":
+		q.Query = queries[q.QueryRef]
+		return nil
+	case q.QueryFile != "":
+		buf, err := readQueryFile(q.QueryFile)
+		if err != nil {
+			return fmt.Errorf("failed to read query_file %q: %w", q.QueryFile, err)
+		}
+		raw = buf
+	case q.QueryBase64 != "":
+		buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(q.QueryBase64))
+		if err != nil {
+			return fmt.Errorf("failed to decode query_base64: %w", err)
+		}
+		raw = buf
+	default:
+		return nil
+	}
+	query, err := replaceEnvironmentPlaceholders(string(raw))
+	if err != nil {
+		return err
+	}
+	q.Query = query
+	return nil
+}
+
+// readQueryFile returns the content of the file, transparently decompressing
+// gzip files
+func readQueryFile(path string) ([]byte, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var r io.Reader = fh
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return io.ReadAll(r)
+}
+
 // Run executes a single Query on a single connection
 func (q *Query) Run(conn *connection) error {
 	if q.log == nil {
 		q.log = log.NewNopLogger()
 	}
 	queryCounter.WithLabelValues(q.jobName, q.Name).Inc()
-	if q.desc == nil {
+	q.Lock()
+	initialized := q.desc != nil
+	q.Unlock()
+	if !initialized {
 		failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
 		return fmt.Errorf("metrics descriptor is nil")
 	}
@@ -24,70 +183,430 @@ func (q *Query) Run(conn *connection) error {
 		failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
 		return fmt.Errorf("query is empty")
 	}
-	if conn == nil || conn.conn == nil {
+	if conn == nil || conn.conn.Load() == nil {
 		failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
 		return fmt.Errorf("db connection not initialized (should not happen)")
 	}
-	// execute query
-	now := time.Now()
-	rows, err := conn.conn.Queryx(q.Query)
-	if err != nil {
-		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+	// the fallback queries are tried in order if the previous one refers to
+	// something the database doesn't have, e.g. an older server version
+	var (
+		query  string
+		result *queryResult
+	)
+	variants := append([]string{q.Query}, q.FallbackQueries...)
+	for i, variant := range variants {
+		var err error
+		query, result, err = q.fetchQuery(conn, variant)
+		if err == nil {
+			queryVariantGauge.WithLabelValues(q.jobName, q.Name, conn.host, conn.database).Set(float64(i))
+			break
+		}
+		if i < len(variants)-1 && isUndefinedObject(err) {
+			level.Debug(q.log).Log("msg", "Query refers to an unknown object, trying the next fallback query", "err", err, "host", conn.host, "fallback", i+1)
+			continue
+		}
+		setFailedScrape(conn, q.jobName, q.Name, 1.0)
 		failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
 		return err
 	}
-	defer rows.Close()
-	duration := time.Since(now)
-	queryDurationHistogram.WithLabelValues(q.jobName, q.Name).Observe(duration.Seconds())
+	return q.process(conn, query, result)
+}
 
-	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.metrics))
-	for rows.Next() {
-		res := make(map[string]interface{})
-		err := rows.MapScan(res)
+// process turns the result of the query text run on the connection into the
+// metrics of the connection
+func (q *Query) process(conn *connection, query string, result *queryResult) error {
+	q.checkSchema(conn, result.columns)
+
+	rows := result.rows
+	if q.JSONColumn != "" {
+		var err error
+		rows, err = q.expandJSON(rows)
 		if err != nil {
-			level.Error(q.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database)
-			failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
-			continue
+			setFailedScrape(conn, q.jobName, q.Name, 1.0)
+			failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
+			return err
+		}
+	}
+	q.establishHelp(rows)
+	if q.Aggregate != "" {
+		var err error
+		rows, err = q.aggregateRows(rows, result.columnTypes)
+		if err != nil {
+			setFailedScrape(conn, q.jobName, q.Name, 1.0)
+			failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
+			return err
 		}
-		m, err := q.updateMetrics(conn, res)
+	}
+
+	// every row of a scalar query would yield the same series
+	if len(q.Values) == 0 && len(rows) > 1 && len(rows[0]) == 1 {
+		setFailedScrape(conn, q.jobName, q.Name, 1.0)
+		failedQueryCounter.WithLabelValues(q.jobName, q.Name).Inc()
+		return fmt.Errorf("query without values returned %d rows, list the value columns in values", len(rows))
+	}
+
+	updated := 0
+	metrics := make([]prometheus.Metric, 0, len(q.metrics))
+	state := q.newSeriesState(conn)
+	for _, res := range rows {
+		m, err := q.updateMetrics(conn, res, result.columnTypes, state)
 		if err != nil {
-			level.Error(q.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database)
-			failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(1.0)
+			level.Error(q.log).Log("msg", "Failed to update metrics", "err", err, "host", conn.host, "db", conn.database, "connection", conn.name)
+			setFailedScrape(conn, q.jobName, q.Name, 1.0)
 			continue
 		}
 		metrics = append(metrics, m...)
 		updated++
-		failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(0.0)
+		setFailedScrape(conn, q.jobName, q.Name, 0.0)
 	}
 
 	if updated < 1 {
 		if q.AllowZeroRows {
-			failedScrapes.WithLabelValues(conn.driver, conn.host, conn.database, conn.user, q.jobName, q.Name).Set(0.0)
+			setFailedScrape(conn, q.jobName, q.Name, 0.0)
 		} else {
 			return fmt.Errorf("zero rows returned")
 		}
 	}
 
+	q.finishSeriesState(conn, state)
+
 	// update the metrics cache
 	q.Lock()
 	q.metrics[conn] = metrics
+	q.lastSuccess = time.Now()
+	if q.updated == nil {
+		q.updated = make(map[*connection]time.Time)
+	}
+	q.updated[conn] = q.lastSuccess
+	series := 0
+	for _, m := range q.metrics {
+		series += len(m)
+	}
+	active := distinctSeries(q.metrics)
+	q.Unlock()
+	querySeriesGauge.WithLabelValues(q.jobName, q.Name).Set(float64(series))
+	queryActiveSeries.WithLabelValues(q.jobName, q.Name).Set(float64(active))
+
+	if q.Explain {
+		if err := q.explain(conn, query); err != nil {
+			level.Warn(q.log).Log("msg", "Failed to explain query", "err", err, "host", conn.host, "db", conn.database)
+		}
+	}
+	return nil
+}
+
+// fetchQuery runs the query text on the connection, or takes the result from
+// the cache, and returns the query text actually run
+func (q *Query) fetchQuery(conn *connection, query string) (string, *queryResult, error) {
+	if q.AutoLimit > 0 {
+		limited, err := limitQuery(conn.driver, query, q.AutoLimit)
+		if err != nil {
+			level.Warn(q.log).Log("msg", "Not applying auto_limit", "err", err, "driver", conn.driver)
+		} else {
+			query = limited
+		}
+	}
+	var result *queryResult
+	// pre_sql may change the result of the query, e.g. by setting the search_path
+	cacheKey := strings.Join(append([]string{conn.driver, conn.url, query}, q.PreSQL...), "\x00")
+	if q.CacheTTL > 0 {
+		result = results.get(cacheKey, q.CacheTTL)
+	}
+	if result != nil {
+		level.Debug(q.log).Log("msg", "Using cached result", "fetched", result.fetched)
+		queryCacheHitsCounter.WithLabelValues(q.jobName, q.Name).Inc()
+		return query, result, nil
+	}
+	err := q.retry(func() error {
+		var err error
+		if len(q.PreSQL) > 0 || len(q.PostSQL) > 0 {
+			result, err = q.fetchInSession(conn, query)
+		} else {
+			result, err = q.fetchWithTimeout(context.Background(), conn.conn.Load(), conn, query)
+		}
+		return err
+	})
+	if err != nil {
+		return query, nil, err
+	}
+	// cached results didn't cost the database anything
+	queryRowsProcessedCounter.WithLabelValues(q.jobName, q.Name).Add(float64(len(result.rows)))
+	if q.CacheTTL > 0 {
+		results.set(cacheKey, result)
+	}
+	return query, result, nil
+}
+
+// distinctSeries counts the distinct label sets of the metrics, connections
+// with the same labels yield the same series
+func distinctSeries(metrics map[*connection][]prometheus.Metric) int {
+	seen := make(map[string]struct{})
+	for _, ms := range metrics {
+		for _, m := range ms {
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				continue
+			}
+			var key strings.Builder
+			key.WriteString(m.Desc().String())
+			for _, label := range pb.GetLabel() {
+				key.WriteString("\x00" + label.GetName() + "=" + label.GetValue())
+			}
+			seen[key.String()] = struct{}{}
+		}
+	}
+	return len(seen)
+}
+
+// checkSchema counts and logs changes of the returned columns compared to the
+// previous run on the same connection
+func (q *Query) checkSchema(conn *connection, columns []string) {
+	if columns == nil {
+		return
+	}
+	q.Lock()
+	if q.columns == nil {
+		q.columns = make(map[*connection][]string)
+	}
+	previous, seen := q.columns[conn]
+	q.columns[conn] = columns
 	q.Unlock()
+	if !seen {
+		return
+	}
+	var added, removed []string
+	for _, column := range columns {
+		if !slices.Contains(previous, column) {
+			added = append(added, column)
+		}
+	}
+	for _, column := range previous {
+		if !slices.Contains(columns, column) {
+			removed = append(removed, column)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	querySchemaChangedCounter.WithLabelValues(q.jobName, q.Name).Inc()
+	level.Warn(q.log).Log("msg", "Columns returned by the query changed", "added", strings.Join(added, ","), "removed", strings.Join(removed, ","), "host", conn.host, "db", conn.database, "connection", conn.name)
+}
+
+// retry runs fetch again after transient errors, at most query_retries times
+func (q *Query) retry(fetch func() error) error {
+	if q.QueryRetries <= 0 {
+		return fetch()
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 100 * time.Millisecond
+	bo.MaxInterval = time.Second
+	return backoff.RetryNotify(func() error {
+		err := fetch()
+		if err != nil && !isTransient(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithMaxRetries(bo, uint64(q.QueryRetries)), func(err error, next time.Duration) {
+		level.Debug(q.log).Log("msg", "Retrying query after transient error", "err", err, "in", next)
+		queryRetriesCounter.WithLabelValues(q.jobName, q.Name).Inc()
+	})
+}
+
+// fetchInSession executes PreSQL, the query and PostSQL on a dedicated
+// session
+func (q *Query) fetchInSession(conn *connection, query string) (*queryResult, error) {
+	var result *queryResult
+	err := q.inSession(conn, func(ctx context.Context, session txQueryer) error {
+		var err error
+		result, err = q.fetchWithTimeout(ctx, session, conn, query)
+		return err
+	})
+	return result, err
+}
+
+// inSession executes PreSQL, run and PostSQL on a dedicated session. Unless
+// PostSQL resets it, the session is discarded afterwards so the state set by
+// PreSQL can't leak into other queries.
+func (q *Query) inSession(conn *connection, run func(ctx context.Context, session txQueryer) error) error {
+	ctx := context.Background()
+	session, err := conn.conn.Load().Connx(ctx)
+	if err != nil {
+		return err
+	}
+	reusable := false
+	defer func() {
+		if !reusable {
+			// returning ErrBadConn makes the pool close the session
+			_ = session.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		_ = session.Close()
+	}()
 
+	for _, stmt := range q.PreSQL {
+		if _, err := session.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("pre_sql %q failed: %w", stmt, err)
+		}
+	}
+	if err := run(ctx, session); err != nil {
+		return err
+	}
+	if len(q.PostSQL) > 0 {
+		reusable = true
+		for _, stmt := range q.PostSQL {
+			if _, err := session.ExecContext(ctx, stmt); err != nil {
+				level.Warn(q.log).Log("msg", "post_sql failed, discarding the session", "err", err, "query", stmt)
+				reusable = false
+				break
+			}
+		}
+	}
 	return nil
 }
 
+// txQueryer is a connection pool or a single session which can start a
+// transaction
+type txQueryer interface {
+	sqlx.QueryerContext
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+}
+
+// fetchWithTimeout fetches the result with the statement_timeout enforced by
+// the database. Drivers without support run the query without a timeout.
+func (q *Query) fetchWithTimeout(ctx context.Context, db txQueryer, conn *connection, query string) (*queryResult, error) {
+	if q.StatementTimeout <= 0 {
+		return q.fetch(ctx, q.prepared(ctx, db, conn, query), conn, query)
+	}
+	setup, limited, err := statementTimeout(conn.driver, query, q.StatementTimeout)
+	if err != nil {
+		level.Warn(q.log).Log("msg", "Not applying statement_timeout", "err", err, "driver", conn.driver)
+		return q.fetch(ctx, q.prepared(ctx, db, conn, query), conn, query)
+	}
+	if setup == "" {
+		return q.fetch(ctx, q.prepared(ctx, db, conn, limited), conn, limited)
+	}
+	// the setting ends with the transaction, which only reads anyway unless
+	// the query is of type exec
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, setup); err != nil {
+		return nil, fmt.Errorf("failed to set statement_timeout: %w", err)
+	}
+	result, err := q.fetch(ctx, tx, conn, limited)
+	if err != nil || q.Type != TypeExec {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+// fetch executes the query and reads all rows of the result set
+func (q *Query) fetch(ctx context.Context, db sqlx.QueryerContext, conn *connection, query string) (*queryResult, error) {
+	if q.Type == TypeExec {
+		// all connections, sessions, transactions and statements can execute
+		return q.exec(ctx, db.(sqlx.ExecerContext), query)
+	}
+	now := time.Now()
+	rows, err := db.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if q.TrackDuration == nil || *q.TrackDuration {
+		duration := time.Since(now)
+		queryDurationHistogram.WithLabelValues(q.jobName, q.Name).Observe(duration.Seconds())
+	}
+
+	return q.readResult(rows, conn, now)
+}
+
+// readResult reads all rows of the current result set
+func (q *Query) readResult(rows *sqlx.Rows, conn *connection, fetched time.Time) (*queryResult, error) {
+	result := &queryResult{fetched: fetched}
+	renamed := false
+	if columns, err := rows.Columns(); err == nil {
+		result.columns = columns
+		if duplicates := duplicateColumns(columns); len(duplicates) > 0 {
+			switch q.DuplicateColumns {
+			case DuplicateColumnsError:
+				return nil, fmt.Errorf("duplicate column names %v, alias them or set duplicate_columns to %s", duplicates, DuplicateColumnsRename)
+			case DuplicateColumnsRename:
+				result.columns = renameDuplicateColumns(columns)
+				renamed = true
+			default:
+				level.Warn(q.log).Log("msg", "Duplicate column names, only the last of each is used", "columns", fmt.Sprint(duplicates), "connection", conn.name)
+			}
+		}
+	}
+	if types, err := rows.ColumnTypes(); err == nil {
+		result.columnTypes = make(map[string]string, len(types))
+		for i, t := range types {
+			name := t.Name()
+			if renamed && i < len(result.columns) {
+				name = result.columns[i]
+			}
+			result.columnTypes[name] = t.DatabaseTypeName()
+		}
+	}
+	returned := 0
+	for rows.Next() {
+		returned++
+		if q.ExpectSingleRow && returned > 1 {
+			unexpectedRowsCounter.WithLabelValues(q.jobName, q.Name).Inc()
+			return nil, fmt.Errorf("expected a single row but the query returned more")
+		}
+		res := make(map[string]interface{})
+		var err error
+		if renamed {
+			err = scanRenamed(rows, result.columns, res)
+		} else {
+			err = rows.MapScan(res)
+		}
+		if err != nil {
+			level.Error(q.log).Log("msg", "Failed to scan", "err", err, "host", conn.host, "db", conn.database, "connection", conn.name)
+			setFailedScrape(conn, q.jobName, q.Name, 1.0)
+			queryScanErrorsCounter.WithLabelValues(q.jobName, q.Name).Inc()
+			continue
+		}
+		result.rows = append(result.rows, res)
+	}
+	return result, nil
+}
+
 // updateMetrics parses the result set and returns a slice of const metrics
-func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]prometheus.Metric, error) {
-	// if no value were defined to be parsed, return immediately
-	if len(q.Values) == 0 {
-		level.Debug(q.log).Log("msg", "No values defined in configuration, skipping metric update")
-		return nil, nil
+func (q *Query) updateMetrics(conn *connection, res map[string]interface{}, columnTypes map[string]string, state *seriesState) ([]prometheus.Metric, error) {
+	values := q.Values
+	if len(values) == 0 {
+		// a query returning a single column is a scalar, its column is the value
+		if len(res) != 1 {
+			level.Debug(q.log).Log("msg", "No values defined in configuration, skipping metric update")
+			return nil, nil
+		}
+		for column := range res {
+			values = []string{column}
+		}
+	}
+	var ts time.Time
+	if q.Timestamp != "" {
+		if tsRaw, ok := res[q.Timestamp]; ok && !isNull(tsRaw) {
+			t, err := parseTimestamp(tsRaw)
+			if err != nil {
+				level.Warn(q.log).Log("msg", "Ignoring timestamp", "column", q.Timestamp, "err", err)
+			} else if err := q.checkTimestamp(t); err != nil {
+				// prometheus silently drops samples outside of its window, so
+				// drop them here where it can be counted
+				timestampOutOfWindowCounter.WithLabelValues(q.jobName, q.Name).Inc()
+				return nil, err
+			} else {
+				ts = t
+			}
+		}
 	}
 	updated := 0
-	metrics := make([]prometheus.Metric, 0, len(q.Values))
-	for _, valueName := range q.Values {
-		m, err := q.updateMetric(conn, res, valueName)
+	metrics := make([]prometheus.Metric, 0, len(values))
+	for _, valueName := range values {
+		ms, err := q.updateMetric(conn, res, valueName, columnTypes, state)
 		if err != nil {
 			level.Error(q.log).Log(
 				"msg", "Failed to update metric",
@@ -96,10 +615,17 @@ func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]p
 				"host", conn.host,
 				"db", conn.database,
 			)
+			queryValueFailuresCounter.WithLabelValues(q.jobName, q.Name, valueName).Inc()
 			continue
 		}
-		metrics = append(metrics, m)
+		// a delta without a previous value has no metric but counts
 		updated++
+		for _, m := range ms {
+			if !ts.IsZero() {
+				m = prometheus.NewMetricWithTimestamp(ts, m)
+			}
+			metrics = append(metrics, m)
+		}
 	}
 	if updated < 1 {
 		return nil, fmt.Errorf("zero values found")
@@ -107,42 +633,16 @@ func (q *Query) updateMetrics(conn *connection, res map[string]interface{}) ([]p
 	return metrics, nil
 }
 
-// updateMetrics parses a single row and returns a const metric
-func (q *Query) updateMetric(conn *connection, res map[string]interface{}, valueName string) (prometheus.Metric, error) {
+// updateMetric parses a value of a single row and returns its const
+// metrics
+func (q *Query) updateMetric(conn *connection, res map[string]interface{}, valueName string, columnTypes map[string]string, state *seriesState) ([]prometheus.Metric, error) {
 	var value float64
 	if i, ok := res[valueName]; ok {
-		switch f := i.(type) {
-		case int:
-			value = float64(f)
-		case int32:
-			value = float64(f)
-		case int64:
-			value = float64(f)
-		case uint:
-			value = float64(f)
-		case uint32:
-			value = float64(f)
-		case uint64:
-			value = float64(f)
-		case float32:
-			value = float64(f)
-		case float64:
-			value = float64(f)
-		case []uint8:
-			val, err := strconv.ParseFloat(string(f), 64)
-			if err != nil {
-				return nil, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
-			}
-			value = val
-		case string:
-			val, err := strconv.ParseFloat(f, 64)
-			if err != nil {
-				return nil, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
-			}
-			value = val
-		default:
-			return nil, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", valueName, i, f)
+		val, err := parseFloat(valueName, i)
+		if err != nil {
+			return nil, withColumnType(err, valueName, columnTypes)
 		}
+		value = val
 	} else {
 		level.Warn(q.log).Log(
 			"msg", "Column not found in query result",
@@ -152,51 +652,251 @@ func (q *Query) updateMetric(conn *connection, res map[string]interface{}, value
 	}
 	// make space for all defined variable label columns and the "static" labels
 	// added below
-	labels := make([]string, 0, len(q.Labels)+5)
+	labels := make([]string, 0, len(q.Labels)+7)
 	for _, label := range q.Labels {
 		// we need to fill every spot in the slice or the key->value mapping
 		// won't match up in the end.
 		//
 		// ORDER MATTERS!
 		lv := ""
-		if i, ok := res[label]; ok {
+		if i, ok := res[label.Column]; ok {
 			switch str := i.(type) {
 			case string:
 				lv = str
 			case []uint8:
 				lv = string(str)
 			default:
-				return nil, fmt.Errorf("column '%s' must be type text (string)", label)
+				return nil, withColumnType(fmt.Errorf("column '%s' must be type text (string), is '%T'", label.Column, i), label.Column, columnTypes)
 			}
 		}
+		if re, found := q.redactions[label.Label]; found {
+			lv = re.ReplaceAllString(lv, redactedPlaceholder)
+		}
 		labels = append(labels, lv)
 	}
 	labels = append(labels, conn.driver)
 	labels = append(labels, conn.host)
 	labels = append(labels, conn.database)
 	labels = append(labels, conn.user)
-	labels = append(labels, valueName)
-	// create a new immutable const metric that can be cached and returned on
-	// every scrape. Remember that the order of the label values in the labels
-	// slice must match the order of the label names in the descriptor!
-	metric, err := prometheus.NewConstMetric(
-		q.desc, prometheus.GaugeValue, value, labels...,
-	)
+	if q.connectionName {
+		labels = append(labels, conn.name)
+	}
+	if q.roleLabel != "" {
+		labels = append(labels, conn.role)
+	}
+	for _, label := range q.connectionLabels {
+		labels = append(labels, conn.labels[label])
+	}
+	role := ""
+	if len(q.suffixRoles) > 0 {
+		role = conn.role
+	}
+	metrics := make([]prometheus.Metric, 0, 1)
+	if state != nil {
+		q.checkRange(state, valueName, value)
+		if q.isDelta(valueName) {
+			delta, ok := q.delta(state, valueName, labels, value)
+			if !ok {
+				return nil, nil
+			}
+			value = delta
+		}
+		if cfg, found := q.Smoothing[valueName]; found {
+			if cfg.KeepRaw {
+				metric, err := q.constMetric(role, valueName+rawSuffix, value, labels)
+				if err != nil {
+					return nil, err
+				}
+				metrics = append(metrics, metric)
+			}
+			value = q.smooth(state, cfg, valueName, labels, value)
+		}
+	}
+	metric, err := q.constMetric(role, valueName, value, labels)
 	if err != nil {
 		return nil, err
 	}
-	if q.Timestamp != "" {
-		if tsRaw, ok := res[q.Timestamp]; ok {
-			switch ts := tsRaw.(type) {
-			case time.Time:
-				return prometheus.NewMetricWithTimestamp(ts, metric), nil
-			default:
-				level.Warn(q.log).Log(
-					"msg", "timestamp label %q is of type %T, expected time.Time",
-					"column", tsRaw,
-				)
-			}
+	return append(metrics, metric), nil
+}
+
+// constMetric creates a new immutable const metric that can be cached and
+// returned on every scrape. Remember that the order of the label values in
+// the labels slice must match the order of the label names in the
+// descriptor!
+func (q *Query) constMetric(role, valueName string, value float64, labels []string) (prometheus.Metric, error) {
+	if !q.SeparateMetrics {
+		labels = append(labels[:len(labels):len(labels)], valueName)
+	}
+	desc, valueType := q.valueDesc(role, valueName)
+	return prometheus.NewConstMetric(desc, valueType, value, labels...)
+}
+
+// withColumnType adds the type the database declared for the column to err,
+// which is usually more telling than the Go type the driver returned
+func withColumnType(err error, column string, columnTypes map[string]string) error {
+	if t := columnTypes[column]; t != "" {
+		return fmt.Errorf("%w, declared as %s by the database", err, t)
+	}
+	return err
+}
+
+// parseFloat converts a value column to float
+func parseFloat(column string, i interface{}) (float64, error) {
+	switch f := i.(type) {
+	case int:
+		return float64(f), nil
+	case int32:
+		return float64(f), nil
+	case int64:
+		return float64(f), nil
+	case uint:
+		return float64(f), nil
+	case uint32:
+		return float64(f), nil
+	case uint64:
+		return float64(f), nil
+	case float32:
+		return float64(f), nil
+	case float64:
+		return f, nil
+	case time.Time:
+		return timeSeconds(f), nil
+	case *time.Time:
+		if f == nil {
+			return 0, fmt.Errorf("column '%s' is NULL", column)
+		}
+		return timeSeconds(*f), nil
+	case []uint8:
+		val, err := strconv.ParseFloat(string(f), 64)
+		if err != nil {
+			return 0, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+		}
+		return val, nil
+	case string:
+		val, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return 0, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+		}
+		return val, nil
+	default:
+		return 0, fmt.Errorf("column '%s' must be type float, is '%T' (val: %s)", column, i, f)
+	}
+}
+
+// timestampLayouts are tried in order for timestamps returned as text
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseTimestamp converts the timestamp column. Depending on the driver and
+// column type it is a time.Time, a formatted string or a unix timestamp in
+// seconds.
+func parseTimestamp(i interface{}) (time.Time, error) {
+	var text string
+	switch ts := i.(type) {
+	case time.Time:
+		return ts, nil
+	case *time.Time:
+		// drivers return nullable columns as pointers, NULL has been skipped
+		return *ts, nil
+	case []uint8:
+		text = string(ts)
+	case string:
+		text = ts
+	default:
+		seconds, err := parseFloat("timestamp", i)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unsupported timestamp type %T", i)
+		}
+		return unixTime(seconds), nil
+	}
+	text = strings.TrimSpace(text)
+	for _, layout := range timestampLayouts {
+		if ts, err := time.Parse(layout, text); err == nil {
+			return ts, nil
 		}
 	}
-	return metric, nil
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil {
+		return unixTime(seconds), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported timestamp format %q", text)
+}
+
+// timeSeconds converts a time value column to a unix timestamp in seconds
+func timeSeconds(t time.Time) float64 {
+	return float64(t.Unix()) + float64(t.Nanosecond())/float64(time.Second)
+}
+
+// isNull reports whether a column is NULL, which drivers return as nil or as
+// a nil pointer for nullable time columns
+func isNull(i interface{}) bool {
+	if ts, ok := i.(*time.Time); ok {
+		return ts == nil
+	}
+	return i == nil
+}
+
+func unixTime(seconds float64) time.Time {
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
+// checkTimestamp rejects timestamps outside of timestamp_max_age and
+// timestamp_max_future, unset bounds are not checked
+func (q *Query) checkTimestamp(ts time.Time) error {
+	now := time.Now()
+	if q.TimestampMaxAge > 0 && ts.Before(now.Add(-q.TimestampMaxAge)) {
+		return fmt.Errorf("timestamp %s is older than %s", ts.Format(time.RFC3339), q.TimestampMaxAge)
+	}
+	if q.TimestampMaxFuture > 0 && ts.After(now.Add(q.TimestampMaxFuture)) {
+		return fmt.Errorf("timestamp %s is more than %s in the future", ts.Format(time.RFC3339), q.TimestampMaxFuture)
+	}
+	return nil
+}
+
+// newFailedScrapes creates the failed scrapes gauge with the configured name
+// and subset of labels
+func newFailedScrapes(cfg MetricConfig) (*prometheus.GaugeVec, []string, error) {
+	name := cfg.Name
+	if name == "" {
+		name = fmt.Sprintf("%s_last_scrape_failed", metricsPrefix)
+	}
+	labels := cfg.Labels
+	if labels == nil {
+		labels = FailedScrapesLabels
+	}
+	for _, label := range labels {
+		if !slices.Contains(FailedScrapesLabels, label) {
+			return nil, nil, fmt.Errorf("unknown label %q for %s, must be one of %v", label, name, FailedScrapesLabels)
+		}
+	}
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: name,
+			Help: "Failed scrapes",
+		},
+		labels,
+	), labels, nil
+}
+
+// setFailedScrape sets the failed scrapes gauge of a query on a connection
+func setFailedScrape(conn *connection, jobName, queryName string, value float64) {
+	all := map[string]string{
+		"driver":     conn.driver,
+		"host":       conn.host,
+		"database":   conn.database,
+		"user":       conn.user,
+		"connection": conn.name,
+		"sql_job":    jobName,
+		"query":      queryName,
+	}
+	labels := make(prometheus.Labels, len(failedScrapesLabels))
+	for _, label := range failedScrapesLabels {
+		labels[label] = all[label]
+	}
+	failedScrapes.With(labels).Set(value)
 }
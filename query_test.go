@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNullableTimeValues(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	var null *time.Time
+
+	if !isNull(nil) || !isNull(null) {
+		t.Error("nil and a nil *time.Time must be NULL")
+	}
+	if isNull(&created) || isNull(created) {
+		t.Error("a time must not be NULL")
+	}
+
+	for _, v := range []interface{}{created, &created} {
+		f, err := parseFloat("created", v)
+		if err != nil {
+			t.Fatalf("parseFloat(%T): %v", v, err)
+		}
+		if want := float64(created.Unix()) + 0.5; f != want {
+			t.Errorf("parseFloat(%T) = %v, want %v", v, f, want)
+		}
+		ts, err := parseTimestamp(v)
+		if err != nil {
+			t.Fatalf("parseTimestamp(%T): %v", v, err)
+		}
+		if !ts.Equal(created) {
+			t.Errorf("parseTimestamp(%T) = %v, want %v", v, ts, created)
+		}
+	}
+	if _, err := parseFloat("created", null); err == nil {
+		t.Error("parseFloat of a nil *time.Time must fail")
+	}
+}
+
+func TestNullableTimestampColumn(t *testing.T) {
+	q := &Query{
+		log:       log.NewNopLogger(),
+		jobName:   "test",
+		Name:      "events",
+		Values:    []string{"count"},
+		Timestamp: "created_at",
+	}
+	q.initDescs("sql_events", "Events")
+	conn := &connection{driver: "postgres", host: "localhost", database: "app"}
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		ts   *time.Time
+		want int64
+	}{
+		{ts: &created, want: created.UnixMilli()},
+		{ts: nil, want: 0},
+	} {
+		res := map[string]interface{}{"count": int64(3), "created_at": tc.ts}
+		metrics, err := q.updateMetrics(conn, res, nil, nil)
+		if err != nil {
+			t.Fatalf("updateMetrics: %v", err)
+		}
+		if len(metrics) != 1 {
+			t.Fatalf("got %d metrics, want 1", len(metrics))
+		}
+		var m dto.Metric
+		if err := metrics[0].Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.GetTimestampMs(); got != tc.want {
+			t.Errorf("timestamp of %v = %d, want %d", tc.ts, got, tc.want)
+		}
+		if got := m.GetGauge().GetValue(); got != 3 {
+			t.Errorf("value = %v, want 3", got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// ValueRange is the range a value column is expected to be in, either bound
+// may be omitted
+type ValueRange struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// contains reports whether the value is within the range
+func (r ValueRange) contains(value float64) bool {
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value <= *r.Max)
+}
+
+// checkRange flags the value column of the run if the value is outside of
+// its value_ranges entry
+func (q *Query) checkRange(s *seriesState, valueName string, value float64) {
+	if r, found := q.ValueRanges[valueName]; found && !r.contains(value) {
+		s.outOfRange[valueName] = true
+	}
+}
+
+// updateOutOfRange sets sql_exporter_query_value_out_of_range of every value
+// column with a range to whether it was outside of it in the last run on any
+// connection. The caller must hold the lock of the query.
+func (q *Query) updateOutOfRange() {
+	for valueName := range q.ValueRanges {
+		outside := 0.0
+		for _, flags := range q.outOfRange {
+			if flags[valueName] {
+				outside = 1
+				break
+			}
+		}
+		queryValueOutOfRange.WithLabelValues(q.jobName, q.Name, valueName).Set(outside)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reload reads the config file again and replaces all jobs. Jobs whose
+// connections did not change keep their open database connections, only
+// their queries are set up again.
+//
+// Changes to the histogram buckets, the failed scrapes metric and the
+// CloudSQL configuration require a restart.
+func (e *Exporter) Reload() error {
+	e.reloading.Lock()
+	defer e.reloading.Unlock()
+	configReloadAttemptSeconds.SetToCurrentTime()
+
+	cfg, err := Read(e.configFile)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	cfg.Jobs = selectJobs(e.logger, cfg.Jobs)
+
+	minInterval = DefaultMinInterval
+	if cfg.Configuration.MinInterval > 0 {
+		minInterval = cfg.Configuration.MinInterval
+	}
+	lintUnits = cfg.Configuration.LintUnits
+	externalLabels = cfg.Configuration.ExternalLabels
+	output.configure(cfg.Configuration.OutputFile)
+
+	e.RLock()
+	previous := make(map[string]*Job, len(e.jobs))
+	for _, job := range e.jobs {
+		previous[job.Name] = job
+	}
+	e.RUnlock()
+
+	jobs := make([]*Job, 0, len(cfg.Jobs))
+	for _, job := range cfg.Jobs {
+		if job == nil {
+			continue
+		}
+		// the connections of the file have to be known to compare them
+		if err := job.loadConnectionsFile(); err != nil {
+			level.Warn(e.logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
+			continue
+		}
+		var err error
+		if prev, found := previous[job.Name]; found && prev.sameConnections(job) {
+			// the previous job must not use the connections anymore once
+			// they are handed over
+			e.stopJob(prev)
+			delete(previous, job.Name)
+			err = job.takeOver(e.logger, cfg.Queries, prev)
+			level.Info(e.logger).Log("msg", "Reusing connections of job", "name", job.Name)
+		} else {
+			err = job.Init(e.logger, cfg.Queries)
+		}
+		if err != nil {
+			level.Warn(e.logger).Log("msg", "Skipping job. Failed to initialize", "err", err, "job", job.Name)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	// whatever is left was removed or its connections changed
+	for _, prev := range previous {
+		e.stopJob(prev)
+		prev.closeConnections()
+		jobScrapeInProgress.DeleteLabelValues(prev.Name)
+		// a new job of the same name has already set these again
+		if !slices.ContainsFunc(cfg.Jobs, func(job *Job) bool { return job != nil && job.Name == prev.Name }) {
+			jobConnections.DeleteLabelValues(prev.Name)
+			jobSuccess.DeleteLabelValues(prev.Name)
+			queryInfo.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+			jobSkippedQueries.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+			queryActiveSeries.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+			querySeriesGauge.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+			queryValueOutOfRange.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		}
+		failoverActive.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		queryPlanTimeSeconds.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		queryExecTimeSeconds.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		queryVariantGauge.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		for _, conn := range prev.conns {
+			connectionLastErrorInfo.DeletePartialMatch(prometheus.Labels{"driver": conn.driver, "host": conn.host})
+			connectionTokenExpiry.DeletePartialMatch(prometheus.Labels{"driver": conn.driver, "host": conn.host})
+		}
+		if slices.Contains(failedScrapesLabels, "sql_job") {
+			failedScrapes.DeletePartialMatch(prometheus.Labels{"sql_job": prev.Name})
+		}
+	}
+
+	e.Lock()
+	e.jobs = jobs
+	e.collectTimeout = cfg.Configuration.CollectTimeout
+	e.metricsTTL = cfg.Configuration.MetricsTTL
+	e.maxCachedMetrics = cfg.Configuration.MaxCachedMetrics
+	e.Unlock()
+	for _, job := range jobs {
+		e.startJob(job)
+	}
+	exportInsecureConnections(jobs)
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
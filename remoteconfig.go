@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// configFetchTimeout limits a single fetch of a remote configuration
+const configFetchTimeout = 30 * time.Second
+
+// isRemoteConfig reports whether the configuration is fetched from a URL
+// instead of being read from a file
+func isRemoteConfig(location string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteConfig is a configuration fetched from a URL. It keeps the
+// validators of the last fetch, so unchanged content isn't sent again.
+type remoteConfig struct {
+	location     string
+	etag         string
+	lastModified string
+}
+
+// fetch returns the configuration, or nil if it didn't change since the
+// last fetch
+func (r *remoteConfig) fetch() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), configFetchTimeout)
+	defer cancel()
+	req, err := r.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+	if err := signS3(req); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config: %s returned %s", r.location, resp.Status)
+	}
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+	return buf, nil
+}
+
+// request builds the GET request of the location. s3://bucket/key is
+// fetched from the virtual hosted endpoint of the bucket.
+func (r *remoteConfig) request(ctx context.Context) (*http.Request, error) {
+	if !strings.HasPrefix(r.location, "s3://") {
+		return http.NewRequestWithContext(ctx, http.MethodGet, r.location, nil)
+	}
+	u, err := url.Parse(r.location)
+	if err != nil {
+		return nil, err
+	}
+	region := s3Session().Config.Region
+	if region == nil || *region == "" {
+		return nil, fmt.Errorf("no AWS region configured to fetch %s", r.location)
+	}
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", u.Host, *region, u.EscapedPath())
+	return http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+}
+
+// s3Session reads the AWS credentials and region like the RDS connections
+func s3Session() *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+}
+
+// signS3 signs requests to S3 with the AWS credentials
+func signS3(req *http.Request) error {
+	if !strings.Contains(req.URL.Host, ".s3.") || !strings.HasSuffix(req.URL.Host, ".amazonaws.com") {
+		return nil
+	}
+	sess := s3Session()
+	if _, err := v4.NewSigner(sess.Config.Credentials).Sign(req, nil, "s3", *sess.Config.Region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign the config request: %w", err)
+	}
+	return nil
+}
+
+// readConfig returns the content of the configuration file or URL
+func readConfig(location string) ([]byte, error) {
+	if isRemoteConfig(location) {
+		return (&remoteConfig{location: location}).fetch()
+	}
+	return os.ReadFile(location)
+}
+
+// watchRemoteConfig fetches the configuration every interval and reloads it
+// once it changed. If it can't be fetched or is invalid the exporter keeps
+// running with the configuration it has.
+func watchRemoteConfig(logger log.Logger, location string, interval time.Duration, reload func() error) {
+	remote := &remoteConfig{location: location}
+	var sum [sha256.Size]byte
+	if buf, err := remote.fetch(); err == nil && buf != nil {
+		sum = sha256.Sum256(buf)
+	}
+	for range time.Tick(interval) {
+		buf, err := remote.fetch()
+		if err != nil {
+			level.Warn(logger).Log("msg", "Failed to fetch config, keeping the current one", "err", err)
+			continue
+		}
+		if buf == nil || sha256.Sum256(buf) == sum {
+			continue
+		}
+		if err := reload(); err != nil {
+			level.Error(logger).Log("msg", "Error reloading changed config", "err", err)
+			// fetch it in full again next time to retry
+			remote.etag, remote.lastModified = "", ""
+			continue
+		}
+		sum = sha256.Sum256(buf)
+		level.Info(logger).Log("msg", "Reloaded changed config", "location", location)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+)
+
+// seriesState holds the values kept across runs of a query on a connection,
+// the last values for deltas and the averages for smoothing, keyed by value
+// column and label values, and the value columns out of range in the run
+type seriesState struct {
+	previous   map[string]float64
+	current    map[string]float64
+	outOfRange map[string]bool
+}
+
+// newSeriesState starts a run of the query on the connection, it is nil if
+// no value depends on the previous run or is checked against a range
+func (q *Query) newSeriesState(conn *connection) *seriesState {
+	if len(q.Deltas) == 0 && len(q.Smoothing) == 0 && len(q.ValueRanges) == 0 {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	return &seriesState{
+		previous:   q.lastValues[conn],
+		current:    make(map[string]float64),
+		outOfRange: make(map[string]bool),
+	}
+}
+
+// finishSeriesState keeps the values of the run for the next one, series
+// which are gone are forgotten
+func (q *Query) finishSeriesState(conn *connection, s *seriesState) {
+	if s == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.lastValues == nil {
+		q.lastValues = make(map[*connection]map[string]float64)
+	}
+	q.lastValues[conn] = s.current
+	if len(q.ValueRanges) > 0 {
+		if q.outOfRange == nil {
+			q.outOfRange = make(map[*connection]map[string]bool)
+		}
+		q.outOfRange[conn] = s.outOfRange
+		q.updateOutOfRange()
+	}
+}
+
+// seriesKey identifies the series of a value column
+func seriesKey(valueName string, labels []string) string {
+	return valueName + "\x00" + strings.Join(labels, "\x00")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	// jobFilter limits the jobs run by this exporter by name, all jobs are
+	// run if it is nil
+	jobFilter *regexp.Regexp
+	// exporterShard is matched against the run_on list of the jobs
+	exporterShard string
+)
+
+// setJobFilter compiles the --job.filter expression, which has to match the
+// whole job name
+func setJobFilter(expr string) error {
+	if expr == "" {
+		jobFilter = nil
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid job filter %q: %w", expr, err)
+	}
+	jobFilter = re
+	return nil
+}
+
+// runsHere reports whether the job is meant to be run by this exporter.
+// Jobs with run_on only run on the listed shards.
+func (j *Job) runsHere() bool {
+	if jobFilter != nil && !jobFilter.MatchString(j.Name) {
+		return false
+	}
+	if len(j.RunOn) > 0 && !slices.Contains(j.RunOn, exporterShard) {
+		return false
+	}
+	return true
+}
+
+// selectJobs drops the jobs not meant for this exporter
+func selectJobs(logger log.Logger, jobs []*Job) []*Job {
+	selected := make([]*Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job == nil {
+			continue
+		}
+		if !job.runsHere() {
+			level.Info(logger).Log("msg", "Skipping job. Not meant for this exporter", "job", job.Name, "shard", exporterShard)
+			continue
+		}
+		selected = append(selected, job)
+	}
+	return selected
+}
@@ -0,0 +1,26 @@
+package main
+
+// SmoothingEWMA is the exponentially weighted moving average
+const SmoothingEWMA = "ewma"
+
+// rawSuffix is appended to the column of the raw value of a smoothed value
+const rawSuffix = "_raw"
+
+// SmoothingConfig smooths a value column across runs
+type SmoothingConfig struct {
+	Type    string  `yaml:"type"`     // ewma
+	Alpha   float64 `yaml:"alpha"`    // weight of the current value, between 0 and 1
+	KeepRaw bool    `yaml:"keep_raw"` // also expose the raw value as <column>_raw
+}
+
+// smooth returns the moving average of the value, the first value of a
+// series is taken as is
+func (q *Query) smooth(s *seriesState, cfg *SmoothingConfig, valueName string, labels []string, value float64) float64 {
+	// a delta keeps the last value under the plain key
+	key := SmoothingEWMA + "\x00" + seriesKey(valueName, labels)
+	if previous, found := s.previous[key]; found {
+		value = cfg.Alpha*value + (1-cfg.Alpha)*previous
+	}
+	s.current[key] = value
+	return value
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// snowflakePrivateKey returns the key for key pair authentication given by
+// the private_key_file or the private_key_pem parameter of the connection,
+// nil if there is none. A PEM can't contain newlines in an URL, so
+// private_key_pem may also be the base64 encoded key without the PEM
+// header and footer.
+func snowflakePrivateKey(params url.Values) (*rsa.PrivateKey, error) {
+	var data []byte
+	switch {
+	case params.Get("private_key_file") != "" && params.Get("private_key_pem") != "":
+		return nil, fmt.Errorf("only one of private_key_file and private_key_pem may be set")
+	case params.Get("private_key_file") != "":
+		buf, err := os.ReadFile(params.Get("private_key_file"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private_key_file: %w", err)
+		}
+		data = buf
+	case params.Get("private_key_pem") != "":
+		data = []byte(params.Get("private_key_pem"))
+	default:
+		return nil, nil
+	}
+
+	var der []byte
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	} else {
+		// a + in the query string is decoded as space
+		body := strings.ReplaceAll(strings.TrimSpace(string(data)), " ", "+")
+		buf, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("private key is neither PEM nor base64")
+		}
+		der = buf
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var stalenessDesc = prometheus.NewDesc(
+	fmt.Sprintf("%s_query_staleness_ratio", metricsPrefix),
+	"Time since the last successful run of the query divided by the interval of its job, above 1 it missed runs.",
+	[]string{"sql_job", "query"}, nil,
+)
+
+// period returns the time between two runs of the job. For a cron schedule
+// it is the time between the next two runs.
+func (j *Job) period(now time.Time) time.Duration {
+	if j.CronSchedule.schedule != nil {
+		next := j.CronSchedule.schedule.Next(now)
+		return j.CronSchedule.schedule.Next(next).Sub(next)
+	}
+	return j.Interval
+}
+
+// collectStaleness sends the staleness of every query of the job which
+// succeeded at least once
+func collectStaleness(ch chan<- prometheus.Metric, job *Job, now time.Time) {
+	period := job.period(now)
+	if period <= 0 {
+		return
+	}
+	for _, q := range job.Queries {
+		if q == nil {
+			continue
+		}
+		q.Lock()
+		lastSuccess := q.lastSuccess
+		q.Unlock()
+		if lastSuccess.IsZero() {
+			continue
+		}
+		ratio := now.Sub(lastSuccess).Seconds() / period.Seconds()
+		ch <- prometheus.MustNewConstMetric(stalenessDesc, prometheus.GaugeValue, ratio, job.Name, q.Name)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// statementKeywords returns the lowercase leading keyword of every statement
+// of the query. Comments, string literals and quoted identifiers are skipped,
+// so a semicolon or keyword inside of them doesn't count.
+func statementKeywords(query string) []string {
+	var keywords []string
+	start := true
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return keywords
+			}
+			i += end + 1
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return keywords
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			// doubled quotes escape themselves, so they are just two literals
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return keywords
+			}
+			i += end + 2
+			start = false
+		case c == ';':
+			start = true
+			i++
+		case start && unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(query) && (unicode.IsLetter(rune(query[end])) || query[end] == '_') {
+				end++
+			}
+			keywords = append(keywords, strings.ToLower(query[i:end]))
+			start = false
+			i = end
+		case start && c != '(' && !unicode.IsSpace(rune(c)):
+			// e.g. a statement starting with a placeholder
+			keywords = append(keywords, string(c))
+			start = false
+			i++
+		default:
+			i++
+		}
+	}
+	return keywords
+}
+
+// checkStatements rejects queries with a statement not starting with one of
+// the allowed keywords
+func checkStatements(query string, allowed []string) error {
+	for _, keyword := range statementKeywords(query) {
+		if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, keyword) }) {
+			return fmt.Errorf("statement %q is not in allowed_statements", strings.ToUpper(keyword))
+		}
+	}
+	return nil
+}
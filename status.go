@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JobStatus is the state of a job shown on the status page
+type JobStatus struct {
+	Name        string     `json:"name"`
+	Connections int        `json:"connections"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+// optionalTime returns nil for the zero time
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Status returns the state of all jobs
+func (e *Exporter) Status() []JobStatus {
+	e.RLock()
+	defer e.RUnlock()
+	status := make([]JobStatus, 0, len(e.jobs))
+	for _, job := range e.jobs {
+		job.connsLock.RLock()
+		conns := len(job.conns)
+		job.connsLock.RUnlock()
+		job.statusLock.Lock()
+		s := JobStatus{
+			Name:        job.Name,
+			Connections: conns,
+			LastRun:     optionalTime(job.lastRun),
+			LastError:   job.lastError,
+		}
+		if job.CronSchedule.schedule == nil && !job.lastRunFinished.IsZero() {
+			s.NextRun = optionalTime(job.lastRunFinished.Add(job.Interval))
+		}
+		job.statusLock.Unlock()
+		if job.CronSchedule.schedule != nil {
+			s.NextRun = optionalTime(e.cronScheduler.Entry(job.cronEntry).Next)
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<html>
+<head><title>SQL Exporter Status</title></head>
+<body>
+<h1>SQL Exporter Status</h1>
+<table border="1" cellpadding="4">
+<tr><th>Job</th><th>Connections</th><th>Last run</th><th>Next run</th><th>Last error</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Connections}}</td><td>{{time .LastRun}}</td><td>{{time .NextRun}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ServeStatus shows the state of all jobs as HTML or, if requested by the
+// Accept header or format=json, as JSON
+func (e *Exporter) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	status := e.Status()
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = statusTemplate.Execute(w, status)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TLSConfig configures TLS for the connections of a job, independent of the
+// DSN syntax of the driver
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// Validate checks that the certificate and key are configured together
+func (t *TLSConfig) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// postgresURL adds the lib/pq ssl parameters to the connection URL
+func (t *TLSConfig) postgresURL(conn string) (string, error) {
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+	if t.ServerName != "" {
+		return "", fmt.Errorf("tls: server_name is not supported by the postgres driver")
+	}
+	u, err := url.Parse(conn)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	if t.InsecureSkipVerify {
+		params.Set("sslmode", "require")
+		// lib/pq verifies the CA of sslmode=require if there is a root
+		// certificate
+		params.Del("sslrootcert")
+	} else {
+		// without ca_file the system roots are used, like for mysql
+		params.Set("sslmode", "verify-full")
+		if t.CAFile != "" {
+			params.Set("sslrootcert", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		params.Set("sslcert", t.CertFile)
+		params.Set("sslkey", t.KeyFile)
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// registerMySQL registers the TLS configuration with the MySQL driver and
+// returns the name to reference it in the DSN
+func (t *TLSConfig) registerMySQL(jobName string) (string, error) {
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return "", fmt.Errorf("tls: failed to read ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("tls: no certificates found in ca_file %q", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("tls: failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	name := "sql_exporter_" + jobName
+	if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// insecureTLS reports why the connection does not verify the certificate of
+// the server, based on the parameters of the driver
+func (c *connection) insecureTLS(job *Job) (string, bool) {
+	if job.TLS != nil && job.TLS.InsecureSkipVerify {
+		return "tls.insecure_skip_verify is set", true
+	}
+	if c.driver == "mysql" {
+		cfg, err := mysql.ParseDSN(strings.TrimPrefix(strings.TrimPrefix(c.url, "rds-mysql://"), "mysql://"))
+		if err != nil {
+			return "", false
+		}
+		switch cfg.TLSConfig {
+		case "", "false":
+			return "tls is disabled", true
+		case "skip-verify", "preferred":
+			return "tls=" + cfg.TLSConfig + " does not verify the server", true
+		}
+		return "", false
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", false
+	}
+	params := u.Query()
+	get := func(name string) string {
+		for key, values := range params {
+			if strings.EqualFold(key, name) && len(values) > 0 {
+				return strings.ToLower(values[0])
+			}
+		}
+		return ""
+	}
+	if get("insecure_skip_verify") == "true" || get("tls") == "skip-verify" {
+		return "certificate verification is disabled", true
+	}
+	switch c.driver {
+	case "postgres":
+		// lib/pq defaults to require, which does not verify the server either
+		if mode := get("sslmode"); mode != "verify-ca" && mode != "verify-full" {
+			return "sslmode is not verify-ca or verify-full", true
+		}
+	case "sqlserver":
+		if mode := get("encrypt"); mode == "disable" || mode == "false" {
+			return "encrypt=" + mode, true
+		}
+		if get("trustservercertificate") == "true" {
+			return "trustservercertificate=true", true
+		}
+	case "clickhouse", "clickhouse+tcp", "clickhouse+http":
+		if get("skip_verify") == "true" {
+			return "skip_verify=true", true
+		}
+		if get("secure") != "true" {
+			return "secure is not enabled", true
+		}
+	case "vertica":
+		if mode := get("tlsmode"); mode != "server-strict" {
+			return "tlsmode is not server-strict", true
+		}
+	}
+	return "", false
+}
+
+// exportInsecureConnections replaces the insecure connection gauge with the
+// connections of the given jobs
+func exportInsecureConnections(jobs []*Job) {
+	connectionInsecure.Reset()
+	for _, job := range jobs {
+		job.connsLock.RLock()
+		for _, conn := range job.conns {
+			if _, insecure := conn.insecureTLS(job); insecure {
+				connectionInsecure.WithLabelValues(conn.driver, conn.host).Set(1)
+			}
+		}
+		job.connsLock.RUnlock()
+	}
+}
+
+// certificatesRotated reports whether the certificate, key or CA file of a
+// postgres connection changed since the last call
+func (c *connection) certificatesRotated() bool {
+	if c.driver != "postgres" {
+		return false
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return false
+	}
+	params := u.Query()
+	var latest time.Time
+	for _, param := range []string{"sslcert", "sslkey", "sslrootcert"} {
+		file := params.Get(param)
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	rotated := !c.certsModified.IsZero() && latest.After(c.certsModified)
+	if latest.After(c.certsModified) {
+		c.certsModified = latest
+	}
+	return rotated
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+)
+
+// reservedLabels are added to every query metric by the exporter itself
+var reservedLabels = []string{"driver", "host", "database", "user", "col", "sql_job"}
+
+// connectionLabel is added to the query metrics of jobs with named
+// connections, only those reserve it
+const connectionLabel = "connection"
+
+// charsetRE matches the names of mysql charsets and collations
+var charsetRE = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// Validate checks the static configuration of a query and returns every
+// problem found, so they can be reported at once
+func (q *Query) Validate(queries map[string]string) []error {
+	var errs []error
+	sources := 0
+	for _, source := range []string{q.Query, q.QueryRef, q.QueryFile, q.QueryBase64} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = append(errs, fmt.Errorf("only one of query, query_ref, query_file and query_base64 may be set"))
+	}
+	if q.QueryBase64 != "" {
+		if _, err := base64.StdEncoding.DecodeString(strings.TrimSpace(q.QueryBase64)); err != nil {
+			errs = append(errs, fmt.Errorf("query_base64 is not valid base64: %w", err))
+		}
+	}
+	if q.Unit != "" && MetricNameRE.MatchString(q.Unit) {
+		errs = append(errs, fmt.Errorf("unit %q contains characters invalid in a metric name", q.Unit))
+	}
+	if q.Aggregate != "" {
+		if _, found := aggregators[strings.ToLower(q.Aggregate)]; !found {
+			errs = append(errs, fmt.Errorf("unknown aggregate %q", q.Aggregate))
+		}
+		if q.Timestamp != "" {
+			errs = append(errs, fmt.Errorf("aggregate can't be combined with timestamp"))
+		}
+	}
+	if len(q.PostSQL) > 0 && len(q.PreSQL) == 0 {
+		errs = append(errs, fmt.Errorf("post_sql requires pre_sql"))
+	}
+	if q.Scope != "" && q.Scope != ScopeAll && q.Scope != ScopeAnyOne {
+		errs = append(errs, fmt.Errorf("scope must be %s or %s", ScopeAll, ScopeAnyOne))
+	}
+	if q.Type != "" && q.Type != TypeQuery && q.Type != TypeExec {
+		errs = append(errs, fmt.Errorf("type must be %s or %s", TypeQuery, TypeExec))
+	}
+	if q.Type == TypeExec {
+		// each of them would skip or repeat the statement
+		if q.CacheTTL > 0 {
+			errs = append(errs, fmt.Errorf("cache_ttl can't be combined with type %s", TypeExec))
+		}
+		if q.Explain {
+			errs = append(errs, fmt.Errorf("explain can't be combined with type %s", TypeExec))
+		}
+		if q.AutoLimit > 0 {
+			errs = append(errs, fmt.Errorf("auto_limit can't be combined with type %s", TypeExec))
+		}
+		if q.HelpColumn != "" {
+			errs = append(errs, fmt.Errorf("help_column can't be combined with type %s", TypeExec))
+		}
+		for _, value := range q.Values {
+			if value != rowsAffectedColumn && value != lastInsertIDColumn {
+				errs = append(errs, fmt.Errorf("values of type %s can only be %s and %s", TypeExec, rowsAffectedColumn, lastInsertIDColumn))
+				break
+			}
+		}
+	}
+	labelNames := q.labelNames()
+	for label, expr := range q.LabelRedactions {
+		if !slices.Contains(labelNames, label) {
+			errs = append(errs, fmt.Errorf("label_redactions: %q is not listed in labels", label))
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			errs = append(errs, fmt.Errorf("label_redactions: invalid regular expression for %q: %w", label, err))
+		}
+	}
+	if q.JSONColumn == "" && len(q.JSONPaths) > 0 {
+		errs = append(errs, fmt.Errorf("json_paths requires json_column"))
+	}
+	if q.JSONColumn != "" && len(q.Values) == 0 {
+		errs = append(errs, fmt.Errorf("json_column requires values"))
+	}
+	for column, path := range q.JSONPaths {
+		if column == q.JSONColumn {
+			errs = append(errs, fmt.Errorf("json_paths: %q is the json_column itself", column))
+		}
+		if _, err := parseJSONPath(path); err != nil {
+			errs = append(errs, fmt.Errorf("json_paths: %q: %w", column, err))
+		}
+	}
+	if q.SeparateMetrics && len(q.Values) == 0 {
+		errs = append(errs, fmt.Errorf("separate_metrics requires values"))
+	}
+	if q.StatementTimeout < 0 {
+		errs = append(errs, fmt.Errorf("statement_timeout must not be negative"))
+	}
+	if q.QueryRetries < 0 {
+		errs = append(errs, fmt.Errorf("query_retries must not be negative"))
+	}
+	if q.ExplainInterval < 0 {
+		errs = append(errs, fmt.Errorf("explain_interval must not be negative"))
+	}
+	if q.AutoLimit < 0 {
+		errs = append(errs, fmt.Errorf("auto_limit must not be negative"))
+	}
+	if q.Query == "" && q.QueryRef != "" {
+		if _, found := queries[q.QueryRef]; !found {
+			errs = append(errs, fmt.Errorf("query_ref %q not found in queries", q.QueryRef))
+		}
+	}
+	// a column may only serve a single purpose, e.g. using it both as a label
+	// and as a value yields nonsense metrics
+	usage := make(map[string]string, len(q.Labels)+len(q.Values)+1)
+	use := func(column, kind string) {
+		if prev, found := usage[column]; found {
+			errs = append(errs, fmt.Errorf("column %q is used as %s and as %s", column, prev, kind))
+			return
+		}
+		usage[column] = kind
+	}
+	for label := range q.ConstLabels {
+		if err := validConstLabel(label); err != nil {
+			errs = append(errs, fmt.Errorf("const_labels: %w", err))
+		}
+	}
+	for i, label := range q.Labels {
+		if !model.LabelName(label.Label).IsValid() {
+			errs = append(errs, fmt.Errorf("invalid label name %q", label.Label))
+		}
+		if slices.Contains(reservedLabels, label.Label) {
+			errs = append(errs, fmt.Errorf("label %q is reserved by the exporter", label.Label))
+		}
+		if _, found := q.ConstLabels[label.Label]; found {
+			errs = append(errs, fmt.Errorf("label %q is also a const label", label.Label))
+		}
+		if slices.Contains(labelNames[:i], label.Label) {
+			errs = append(errs, fmt.Errorf("label %q is used twice", label.Label))
+		}
+		use(label.Column, "label")
+	}
+	for _, value := range q.Values {
+		use(value, "value")
+	}
+	if q.Timestamp != "" {
+		use(q.Timestamp, "timestamp")
+	}
+	if q.HelpColumn != "" {
+		use(q.HelpColumn, "help_column")
+		if len(q.Values) == 0 {
+			errs = append(errs, fmt.Errorf("help_column requires values"))
+		}
+	}
+	if _, err := parseValueType(q.ValueType); err != nil {
+		errs = append(errs, fmt.Errorf("value_type: %w", err))
+	}
+	for column, valueType := range q.ValueTypes {
+		if usage[column] != "value" {
+			errs = append(errs, fmt.Errorf("value_types: column %q is not listed in values", column))
+		}
+		if _, err := parseValueType(valueType); err != nil {
+			errs = append(errs, fmt.Errorf("value_types: column %q: %w", column, err))
+		}
+	}
+	for _, column := range q.Deltas {
+		if usage[column] != "value" {
+			errs = append(errs, fmt.Errorf("deltas: column %q is not listed in values", column))
+		}
+	}
+	for column, cfg := range q.Smoothing {
+		if usage[column] != "value" {
+			errs = append(errs, fmt.Errorf("smoothing: column %q is not listed in values", column))
+		}
+		if cfg == nil || cfg.Type != SmoothingEWMA {
+			errs = append(errs, fmt.Errorf("smoothing: column %q: type must be %s", column, SmoothingEWMA))
+			continue
+		}
+		if cfg.Alpha <= 0 || cfg.Alpha > 1 {
+			errs = append(errs, fmt.Errorf("smoothing: column %q: alpha must be greater than 0 and at most 1", column))
+		}
+		if cfg.KeepRaw && usage[column+rawSuffix] != "" {
+			errs = append(errs, fmt.Errorf("smoothing: column %q: keep_raw clashes with column %q", column, column+rawSuffix))
+		}
+	}
+	switch q.DuplicateColumns {
+	case "", DuplicateColumnsWarn, DuplicateColumnsError, DuplicateColumnsRename:
+	default:
+		errs = append(errs, fmt.Errorf("duplicate_columns must be %s, %s or %s", DuplicateColumnsWarn, DuplicateColumnsError, DuplicateColumnsRename))
+	}
+	for column, r := range q.ValueRanges {
+		if usage[column] != "value" {
+			errs = append(errs, fmt.Errorf("value_ranges: column %q is not listed in values", column))
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			errs = append(errs, fmt.Errorf("value_ranges: column %q: min is greater than max", column))
+		}
+	}
+	if q.DeltaOnReset != "" && q.DeltaOnReset != DeltaResetDrop && q.DeltaOnReset != DeltaResetZero {
+		errs = append(errs, fmt.Errorf("delta_on_reset must be %s or %s", DeltaResetDrop, DeltaResetZero))
+	}
+	return errs
+}
+
+// validConstLabel checks the name of a const label
+func validConstLabel(label string) error {
+	if !model.LabelName(label).IsValid() {
+		return fmt.Errorf("invalid label name %q", label)
+	}
+	if slices.Contains(reservedLabels, label) {
+		return fmt.Errorf("label %q is reserved by the exporter", label)
+	}
+	return nil
+}
+
+// Validate checks the static configuration of all jobs and their queries
+func (f File) Validate() []error {
+	var errs []error
+	if f.Configuration.MetricsTTL < 0 {
+		errs = append(errs, fmt.Errorf("metrics_ttl must not be negative"))
+	}
+	if f.Configuration.MaxCachedMetrics < 0 {
+		errs = append(errs, fmt.Errorf("max_cached_metrics must not be negative"))
+	}
+	if f.Configuration.OutputFile != nil {
+		if err := f.Configuration.OutputFile.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for label := range f.Configuration.ExternalLabels {
+		if err := validConstLabel(label); err != nil {
+			errs = append(errs, fmt.Errorf("external_labels: %w", err))
+		}
+	}
+	for i, j := range f.Jobs {
+		if j == nil {
+			errs = append(errs, fmt.Errorf("job #%d: empty job", i))
+			continue
+		}
+		if j.Timezone != "" {
+			if _, err := time.LoadLocation(j.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("job %q: invalid timezone: %w", j.Name, err))
+			}
+		}
+		if !charsetRE.MatchString(j.Charset) {
+			errs = append(errs, fmt.Errorf("job %q: invalid charset %q", j.Name, j.Charset))
+		}
+		if !charsetRE.MatchString(j.Collation) {
+			errs = append(errs, fmt.Errorf("job %q: invalid collation %q", j.Name, j.Collation))
+		}
+		if len(j.ConnectionsCommand) > 0 && j.ConnectionsURL != "" {
+			errs = append(errs, fmt.Errorf("job %q: only one of connections_command and connections_url may be set", j.Name))
+		}
+		if j.MaxParallelConnections < 0 {
+			errs = append(errs, fmt.Errorf("job %q: max_parallel_connections must not be negative", j.Name))
+		}
+		if j.ConnectionsRefresh < 0 {
+			errs = append(errs, fmt.Errorf("job %q: connections_refresh must not be negative", j.Name))
+		}
+		if j.MinSuccessfulQueries < 0 {
+			errs = append(errs, fmt.Errorf("job %q: min_successful_queries must not be negative", j.Name))
+		}
+		if j.FailureThreshold < 0 {
+			errs = append(errs, fmt.Errorf("job %q: failure_threshold must not be negative", j.Name))
+		}
+		if j.OnFailureWebhook != "" {
+			if u, err := url.Parse(j.OnFailureWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("job %q: on_failure_webhook must be an http or https URL", j.Name))
+			}
+		}
+		if j.ConnMaxIdleTime < 0 {
+			errs = append(errs, fmt.Errorf("job %q: conn_max_idle_time must not be negative", j.Name))
+		}
+		if j.RoleLabel != "" {
+			if err := validConstLabel(j.RoleLabel); err != nil {
+				errs = append(errs, fmt.Errorf("job %q: role_label: %w", j.Name, err))
+			}
+			if _, found := f.Configuration.ExternalLabels[j.RoleLabel]; found {
+				errs = append(errs, fmt.Errorf("job %q: role_label %q is also an external label", j.Name, j.RoleLabel))
+			}
+		}
+		if j.RoleSuffix && j.RoleLabel != "" {
+			errs = append(errs, fmt.Errorf("job %q: only one of role_label and role_suffix may be set", j.Name))
+		}
+		if cl := j.ConnectionLabels; cl != nil {
+			if cl.Query == "" || len(cl.Labels) == 0 {
+				errs = append(errs, fmt.Errorf("job %q: connection_labels requires query and labels", j.Name))
+			}
+			for i, label := range cl.Labels {
+				if err := validConstLabel(label); err != nil {
+					errs = append(errs, fmt.Errorf("job %q: connection_labels: %w", j.Name, err))
+				}
+				if _, found := f.Configuration.ExternalLabels[label]; found || label == j.RoleLabel || slices.Contains(cl.Labels[:i], label) {
+					errs = append(errs, fmt.Errorf("job %q: connection_labels: label %q is used twice", j.Name, label))
+				}
+			}
+		}
+		if j.namedConnections() && (j.RoleLabel == connectionLabel || slices.Contains(j.connectionLabelNames(), connectionLabel)) {
+			errs = append(errs, fmt.Errorf("job %q: label %q is set by the named connections of the job", j.Name, connectionLabel))
+		}
+		for _, cc := range j.Connections {
+			if cc.Role != "" && j.RoleLabel == "" && !j.RoleSuffix {
+				errs = append(errs, fmt.Errorf("job %q: connections have a role but the job has neither role_label nor role_suffix", j.Name))
+				break
+			}
+		}
+		for _, cc := range j.Connections {
+			if !strings.HasPrefix(cc.URL, "athena://") {
+				continue
+			}
+			u, err := url.Parse(cc.URL)
+			if err == nil {
+				err = cc.Athena.athenaURL(u)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %q: connection %q: %w", j.Name, cc.Name, err))
+			}
+		}
+		if j.TLS != nil {
+			if err := j.TLS.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("job %q: %w", j.Name, err))
+			}
+		}
+		for k, q := range j.Queries {
+			if q == nil {
+				errs = append(errs, fmt.Errorf("job %q: query #%d: empty query", j.Name, k))
+				continue
+			}
+			for _, err := range q.Validate(f.Queries) {
+				errs = append(errs, fmt.Errorf("job %q: query %q: %w", j.Name, q.Name, err))
+			}
+			for _, label := range q.labelNames() {
+				if _, found := f.Configuration.ExternalLabels[label]; found {
+					errs = append(errs, fmt.Errorf("job %q: query %q: label %q is also an external label", j.Name, q.Name, label))
+				}
+			}
+			if j.RoleLabel != "" {
+				if _, found := q.ConstLabels[j.RoleLabel]; found || slices.Contains(q.labelNames(), j.RoleLabel) {
+					errs = append(errs, fmt.Errorf("job %q: query %q: label %q is also the role_label", j.Name, q.Name, j.RoleLabel))
+				}
+			}
+			for _, label := range j.connectionLabelNames() {
+				if _, found := q.ConstLabels[label]; found || slices.Contains(q.labelNames(), label) {
+					errs = append(errs, fmt.Errorf("job %q: query %q: label %q is also a connection label", j.Name, q.Name, label))
+				}
+			}
+			if j.namedConnections() {
+				if _, found := q.ConstLabels[connectionLabel]; found || slices.Contains(q.labelNames(), connectionLabel) {
+					errs = append(errs, fmt.Errorf("job %q: query %q: label %q is set by the named connections of the job", j.Name, q.Name, connectionLabel))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// unitSuffixes are the base units and suffixes recommended for metric names
+var unitSuffixes = []string{"seconds", "bytes", "meters", "grams", "joules", "volts", "amperes", "celsius", "ratio", "total", "info"}
+
+// lintUnit complains about metric names without a recognized unit suffix
+func (q *Query) lintUnit() error {
+	name := q.metricName()
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(name, "_"+suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("metric name %q has no unit suffix, consider setting unit", name)
+}
+
+// Lint returns naming problems of the metrics, unlike Validate those don't
+// prevent the exporter from working
+func (f File) Lint() []error {
+	if !f.Configuration.LintUnits {
+		return nil
+	}
+	var warnings []error
+	for _, j := range f.Jobs {
+		if j == nil {
+			continue
+		}
+		for _, q := range j.Queries {
+			if q == nil {
+				continue
+			}
+			if err := q.lintUnit(); err != nil {
+				warnings = append(warnings, fmt.Errorf("job %q: query %q: %w", j.Name, q.Name, err))
+			}
+		}
+	}
+	return warnings
+}
+
+// CheckConfig reads the config file and validates it without connecting to
+// any database. Lint warnings are returned separately.
+func CheckConfig(configFile string) (errs []error, warnings []error) {
+	if configFile == "" {
+		configFile = defaultConfigFile
+	}
+	cfg, err := Read(configFile)
+	if err != nil {
+		return []error{err}, nil
+	}
+	return cfg.Validate(), cfg.Lint()
+}
+
+// TestConnections connects to every connection of the selected jobs and runs a
+// trivial query on it. The result of each connection is written to out.
+func TestConnections(logger log.Logger, configFile string, out io.Writer) []error {
+	if configFile == "" {
+		configFile = defaultConfigFile
+	}
+	cfg, err := Read(configFile)
+	if err != nil {
+		return []error{err}
+	}
+	if cfg.CloudSQLConfig != nil {
+		if _, err := registerCloudSQLDrivers(cfg.CloudSQLConfig); err != nil {
+			return []error{err}
+		}
+	}
+	var errs []error
+	for _, job := range selectJobs(logger, cfg.Jobs) {
+		if err := job.loadConnectionsFile(); err != nil {
+			errs = append(errs, fmt.Errorf("job %q: %w", job.Name, err))
+			continue
+		}
+		job.init(logger)
+		job.updateConnections()
+		if len(job.conns) == 0 {
+			errs = append(errs, fmt.Errorf("job %q: no usable connections", job.Name))
+			continue
+		}
+		for _, conn := range job.conns {
+			err := conn.connect(job)
+			if err == nil {
+				_, err = conn.conn.Load().Exec("SELECT 1")
+			}
+			if err != nil {
+				fmt.Fprintf(out, "FAIL\t%s\t%s\t%s\t%s\t%v\n", job.Name, conn.driver, conn.host, conn.database, err)
+				errs = append(errs, fmt.Errorf("job %q: connection to %s/%s failed: %w", job.Name, conn.host, conn.database, err))
+				continue
+			}
+			fmt.Fprintf(out, "OK\t%s\t%s\t%s\t%s\n", job.Name, conn.driver, conn.host, conn.database)
+		}
+		job.closeConnections()
+	}
+	return errs
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// DefaultWarmupTimeout bounds the warmup if warmup_timeout is not set
+const DefaultWarmupTimeout = 30 * time.Second
+
+// warmup connects all connections of the jobs in parallel and returns once
+// all are connected or failed, but after timeout at the latest. Connections
+// still connecting then keep trying in the background.
+func warmup(jobs []*Job, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultWarmupTimeout
+	}
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		for _, conn := range job.conns {
+			wg.Add(1)
+			go func(job *Job, conn *connection) {
+				defer wg.Done()
+				if err := conn.connect(job); err != nil {
+					errorClass := classifyError(err)
+					level.Warn(job.log).Log("msg", "Failed to connect during warmup", "err", err, "error_class", errorClass, "host", conn.host, "connection", conn.name)
+					conn.setLastError(errorClass)
+					return
+				}
+				conn.setLastError("")
+			}(job, conn)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		for _, job := range jobs {
+			level.Warn(job.log).Log("msg", "Warmup timed out, starting anyway", "timeout", timeout)
+		}
+	}
+}
+
+// Ready reports whether the exporter finished starting up, i.e. the warmup
+// of the connections if enabled
+func (e *Exporter) Ready() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
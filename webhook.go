@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// DefaultFailureThreshold is how many consecutive runs of a job have to
+	// fail before on_failure_webhook is called
+	DefaultFailureThreshold = 3
+	// DefaultWebhookInterval is the minimum time between two calls of the
+	// on_failure_webhook of a job
+	DefaultWebhookInterval = time.Hour
+	// webhookTimeout bounds the request to the webhook
+	webhookTimeout = 10 * time.Second
+)
+
+// failureNotification is the JSON body posted to on_failure_webhook
+type failureNotification struct {
+	Job                 string `json:"job"`
+	Error               string `json:"error"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+// trackFailure counts the consecutive failed runs of the job and calls the
+// on_failure_webhook once the threshold is reached, at most once per
+// webhook_interval. A successful run is passed as nil and resets the count.
+func (j *Job) trackFailure(err error) {
+	if err == nil {
+		j.consecutiveFailures = 0
+		return
+	}
+	j.consecutiveFailures++
+	if j.OnFailureWebhook == "" {
+		return
+	}
+	threshold := j.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultFailureThreshold
+	}
+	interval := j.WebhookInterval
+	if interval <= 0 {
+		interval = DefaultWebhookInterval
+	}
+	if j.consecutiveFailures < threshold || time.Since(j.lastWebhook) < interval {
+		return
+	}
+	j.lastWebhook = time.Now()
+	notification := failureNotification{
+		Job:                 j.Name,
+		Error:               err.Error(),
+		ConsecutiveFailures: j.consecutiveFailures,
+	}
+	// the next run must not wait for a slow webhook
+	go func() {
+		if err := postWebhook(j.OnFailureWebhook, notification); err != nil {
+			level.Warn(j.log).Log("msg", "Failed to call the on_failure_webhook", "err", err)
+		}
+	}()
+}
+
+// postWebhook posts the notification as JSON
+func postWebhook(url string, notification failureNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("on_failure_webhook returned %s", resp.Status)
+	}
+	return nil
+}